@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/snyderks/spotkov/lastFm"
+	"github.com/snyderks/spotkov/markov"
+)
+
+// runAlias adds, lists, or removes the user's aliases for songs and
+// artists, or suggests ones to add.
+func runAlias(arguments []string) {
+	if len(arguments) == 0 {
+		fmt.Println("alias needs one of add, list, remove, or suggest. Use -help for details.")
+		os.Exit(2)
+	}
+	action := arguments[0]
+	flags := flag.NewFlagSet("alias "+action, flag.ExitOnError)
+	user := flags.String("lastFm", "", "Your Last.FM User ID")
+	title := flags.String("title", "", "Title of the song as it's written in your history (leave out to alias an artist)")
+	artist := flags.String("artist", "", "Artist as they're written in your history")
+	toTitle := flags.String("toTitle", "", "Title of the song to use instead")
+	toArtist := flags.String("toArtist", "", "Artist to use instead")
+	minSimilarity := flags.Float64("min", 0.85, "How alike two songs or artists have to be to be suggested, between 0 and 1. Suggestions read every scrobble, not just the unique songs, so each pair merges into the one you've played more")
+	top := flags.Int("top", 20, "Number of suggestions to show (0 for all)")
+	flags.Parse(arguments[1:])
+
+	if *user == "" {
+		fmt.Println("alias needs -lastFm. Use -help for details.")
+		os.Exit(2)
+	}
+	aliases, err := markov.ReadAliases(*user)
+	if err != nil && !errors.Is(err, lastFm.ErrNotCached) {
+		fmt.Println("Aliases are saved in the cache, which couldn't be read:", err)
+		os.Exit(1)
+	}
+
+	switch action {
+	case "list":
+		printAliases(aliases)
+		return
+	case "suggest":
+		suggestAliases(*user, aliases, *minSimilarity, *top)
+		return
+	case "add":
+		if *artist == "" || *toArtist == "" || (*title != "" && *toTitle == "") {
+			fmt.Println("alias add needs -artist and -toArtist, along with -title and -toTitle to alias a song.")
+			os.Exit(2)
+		}
+		if *title != "" {
+			aliases.AddSong(lastFm.BaseSong{Artist: *artist, Title: *title}, lastFm.BaseSong{Artist: *toArtist, Title: *toTitle})
+		} else {
+			aliases.AddArtist(*artist, *toArtist)
+		}
+	case "remove":
+		if *artist == "" {
+			fmt.Println("alias remove needs -artist, along with -title to remove a song's alias.")
+			os.Exit(2)
+		}
+		removed := false
+		if *title != "" {
+			removed = aliases.RemoveSong(lastFm.BaseSong{Artist: *artist, Title: *title})
+		} else {
+			removed = aliases.RemoveArtist(*artist)
+		}
+		if !removed {
+			fmt.Println("There isn't an alias for that.")
+			os.Exit(1)
+		}
+	default:
+		fmt.Println("alias needs one of add, list, remove, or suggest, not", action+".")
+		os.Exit(2)
+	}
+
+	if err = markov.WriteAliases(*user, aliases); err != nil {
+		fmt.Println("Couldn't save your aliases:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Got it! That'll be used the next time you make a playlist.")
+}
+
+// printAliases lists every alias in the table.
+func printAliases(aliases markov.Aliases) {
+	if len(aliases.Songs) == 0 && len(aliases.Artists) == 0 {
+		fmt.Println("You haven't added any aliases yet.")
+		return
+	}
+	lines := make([]string, 0, len(aliases.Songs)+len(aliases.Artists))
+	for variant, song := range aliases.Songs {
+		lines = append(lines, fmt.Sprintf("%s by %s  ->  %s by %s", variant.Title, variant.Artist, song.Title, song.Artist))
+	}
+	for variant, artist := range aliases.Artists {
+		lines = append(lines, fmt.Sprintf("%s  ->  %s", variant, artist))
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
+
+// suggestAliases prints songs and artists in the user's history that are
+// probably the same, along with how to add an alias for each. It reads the
+// whole history rather than the unique songs because the play counts decide
+// which way each pair is merged.
+func suggestAliases(user string, aliases markov.Aliases, minSimilarity float64, top int) {
+	history, err := lastFm.ReadCachedSongs(user)
+	if err != nil {
+		fmt.Println("Couldn't read your songs from the cache. Make a playlist or run spotkov sync first:", err)
+		os.Exit(1)
+	}
+	suggestions := aliases.SuggestAliases(history, minSimilarity)
+	if len(suggestions) == 0 {
+		fmt.Println("Nothing in your history looks like a duplicate.")
+		return
+	}
+	if top > 0 && len(suggestions) > top {
+		suggestions = suggestions[:top]
+	}
+	for _, s := range suggestions {
+		if s.From.Title == "" {
+			fmt.Printf("%.0f%% alike: %s and %s\n", s.Similarity*100, s.From.Artist, s.To.Artist)
+			fmt.Printf("    spotkov alias add -lastFm=%s -artist=%q -toArtist=%q\n", user, s.From.Artist, s.To.Artist)
+			continue
+		}
+		fmt.Printf("%.0f%% alike: %s by %s and %s by %s\n", s.Similarity*100, s.From.Title, s.From.Artist, s.To.Title, s.To.Artist)
+		fmt.Printf("    spotkov alias add -lastFm=%s -artist=%q -title=%q -toArtist=%q -toTitle=%q\n",
+			user, s.From.Artist, s.From.Title, s.To.Artist, s.To.Title)
+	}
+}
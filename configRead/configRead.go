@@ -21,6 +21,10 @@ type Config struct {
 	AuthRedirectURL string `json:"auth-redirect-url"`
 	Debug           bool   `json:"debug"`
 	RedisURL        string `json:"redis-url"`
+	// HistorySource is where listening history is read from by default,
+	// either "lastfm" or "listenbrainz".
+	HistorySource     string `json:"history-source,omitempty"`
+	ListenBrainzToken string `json:"listenbrainz-token,omitempty"`
 }
 
 // Read takes a path to a JSON file.
@@ -30,15 +34,17 @@ func Read(path string) (Config, error) {
 	file, err := ioutil.ReadFile(path)
 	if err != nil { // not using json config. Try to get it from env vars
 		config := Config{
-			SpotifyKey:      os.Getenv("SPOTIFY_KEY"),
-			SpotifySecret:   os.Getenv("SPOTIFY_SECRET"),
-			LastFmKey:       os.Getenv("LASTFM_KEY"),
-			LastFmSecret:    os.Getenv("LASTFM_SECRET"),
-			HTTPPort:        os.Getenv("PORT"),
-			Hostname:        os.Getenv("HOSTNAME"),
-			AuthRedirectURL: os.Getenv("AUTH_REDIRECT"),
-			Debug:           os.Getenv("DEBUG") == "1",
-			RedisURL:        os.Getenv("REDIS_URL"),
+			SpotifyKey:        os.Getenv("SPOTIFY_KEY"),
+			SpotifySecret:     os.Getenv("SPOTIFY_SECRET"),
+			LastFmKey:         os.Getenv("LASTFM_KEY"),
+			LastFmSecret:      os.Getenv("LASTFM_SECRET"),
+			HTTPPort:          os.Getenv("PORT"),
+			Hostname:          os.Getenv("HOSTNAME"),
+			AuthRedirectURL:   os.Getenv("AUTH_REDIRECT"),
+			Debug:             os.Getenv("DEBUG") == "1",
+			RedisURL:          os.Getenv("REDIS_URL"),
+			HistorySource:     os.Getenv("HISTORY_SOURCE"),
+			ListenBrainzToken: os.Getenv("LISTENBRAINZ_TOKEN"),
 		}
 		if !strings.Contains(config.HTTPPort, ":") {
 			config.HTTPPort = ":" + config.HTTPPort
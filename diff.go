@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/snyderks/spotkov/lastFm"
+	"github.com/snyderks/spotkov/markov"
+)
+
+// period is a span of time from Start up to, but not including, End.
+type period struct {
+	Start time.Time
+	End   time.Time
+}
+
+// contains reports whether t falls within the period.
+func (p period) contains(t time.Time) bool {
+	return !t.Before(p.Start) && t.Before(p.End)
+}
+
+// parsePeriod reads a period written as a year (2017), a month (2017-06),
+// a day (2017-06-21), or two of those separated by two dots
+// (2017-06..2017-08), which includes all of both ends.
+func parsePeriod(s string) (period, error) {
+	if parts := strings.SplitN(s, "..", 2); len(parts) == 2 {
+		start, err := parsePeriod(parts[0])
+		if err != nil {
+			return period{}, err
+		}
+		end, err := parsePeriod(parts[1])
+		if err != nil {
+			return period{}, err
+		}
+		return period{start.Start, end.End}, nil
+	}
+	layouts := []struct {
+		layout string
+		add    func(time.Time) time.Time
+	}{
+		{"2006", func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+		{"2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+		{"2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+	}
+	for _, l := range layouts {
+		t, err := time.ParseInLocation(l.layout, s, time.Local)
+		if err == nil {
+			return period{t, l.add(t)}, nil
+		}
+	}
+	return period{}, errors.New("Couldn't read the period " + s + ". Use a year, month, or day like 2017, 2017-06, or 2017-06-21.")
+}
+
+// songsIn returns the songs scrobbled within the period, in the same order.
+func songsIn(songs []lastFm.Song, p period) []lastFm.Song {
+	inPeriod := make([]lastFm.Song, 0)
+	for _, song := range songs {
+		if p.contains(song.Timestamp) {
+			inPeriod = append(inPeriod, song)
+		}
+	}
+	return inPeriod
+}
+
+// runDiff compares the chains built from two periods of a user's history
+// and prints what changed.
+func runDiff(arguments []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	user := flags.String("lastFm", "", "Your Last.FM User ID")
+	from := flags.String("from", "", "Period to compare from, like 2016, 2016-06, 2016-06-21, or 2016-01..2016-06")
+	to := flags.String("to", "", "Period to compare to, in the same format as -from")
+	top := flags.Int("top", 10, "Number of changes to show in each section (0 for all)")
+	asJSON := flags.Bool("json", false, "Print the differences as JSON")
+	sources := addSourceFlags(flags)
+	flags.Parse(arguments)
+
+	if *user == "" || *from == "" || *to == "" {
+		fmt.Println("diff needs -lastFm, -from, and -to. Use -help for details.")
+		os.Exit(2)
+	}
+	fromPeriod, err := parsePeriod(*from)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	toPeriod, err := parsePeriod(*to)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	source, err := sources.historySource()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	ctx, stop := interruptContext()
+	titles, err := source.History(ctx, *user)
+	stop()
+	if err != nil {
+		fmt.Println("Couldn't get your listening history:", err)
+		os.Exit(1)
+	}
+	aliases, _ := markov.ReadAliases(*user)
+	titles = markov.Canonicalize(aliases.Apply(titles), aliases.Artists)
+	fromSongs := songsIn(titles, fromPeriod)
+	toSongs := songsIn(titles, toPeriod)
+	if len(fromSongs) == 0 || len(toSongs) == 0 {
+		fmt.Println("You didn't scrobble anything in one of those periods:",
+			len(fromSongs), "songs from", *from, "and", len(toSongs), "songs from", *to)
+		os.Exit(1)
+	}
+
+	diff := markov.DiffHistories(fromSongs, toSongs)
+	if *top > 0 {
+		diff = trimDiff(diff, *top)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(diff); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	printDiff(diff, *from, *to)
+}
+
+// trimDiff keeps only the top n entries of each section of a diff.
+func trimDiff(diff markov.ChainDiff, n int) markov.ChainDiff {
+	songs := func(s []lastFm.BaseSong) []lastFm.BaseSong {
+		if len(s) > n {
+			return s[:n]
+		}
+		return s
+	}
+	changes := func(c []markov.TransitionChange) []markov.TransitionChange {
+		if len(c) > n {
+			return c[:n]
+		}
+		return c
+	}
+	diff.NewSongs = songs(diff.NewSongs)
+	diff.DroppedSongs = songs(diff.DroppedSongs)
+	if len(diff.ChangedSongs) > n {
+		diff.ChangedSongs = diff.ChangedSongs[:n]
+	}
+	diff.NewTransitions = changes(diff.NewTransitions)
+	diff.DroppedTransitions = changes(diff.DroppedTransitions)
+	diff.ChangedTransitions = changes(diff.ChangedTransitions)
+	return diff
+}
+
+// printDiff prints a diff as plain text.
+func printDiff(diff markov.ChainDiff, from, to string) {
+	printSongs := func(heading string, songs []lastFm.BaseSong) {
+		fmt.Println("\n" + heading)
+		for _, song := range songs {
+			fmt.Println(" ", song.Title, "by", song.Artist)
+		}
+	}
+	printChanges := func(heading string, changes []markov.TransitionChange) {
+		fmt.Println("\n" + heading)
+		for _, c := range changes {
+			fmt.Printf("  %s -> %s: %.0f%% -> %.0f%%\n", c.From.Title, c.To.Title, c.Before*100, c.After*100)
+		}
+	}
+	fmt.Println("How your listening changed from", from, "to", to)
+	printSongs("Songs you started playing:", diff.NewSongs)
+	printSongs("Songs you stopped playing:", diff.DroppedSongs)
+	fmt.Println("\nSongs whose share of your plays changed the most:")
+	for _, c := range diff.ChangedSongs {
+		fmt.Printf("  %s by %s: %.1f%% -> %.1f%%\n", c.Title, c.Artist, c.Before*100, c.After*100)
+	}
+	printChanges("New transitions:", diff.NewTransitions)
+	printChanges("Transitions you stopped making:", diff.DroppedTransitions)
+	printChanges("Transitions that changed the most:", diff.ChangedTransitions)
+}
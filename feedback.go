@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/snyderks/spotkov/lastFm"
+	"github.com/snyderks/spotkov/markov"
+)
+
+// runFeedback records a thumbs up or down on a song, or on a transition
+// from one song to another, or lists the feedback given so far.
+func runFeedback(arguments []string) {
+	flags := flag.NewFlagSet("feedback", flag.ExitOnError)
+	user := flags.String("lastFm", "", "Your Last.FM User ID")
+	up := flags.Bool("up", false, "Give the song or transition a thumbs up")
+	down := flags.Bool("down", false, "Give the song or transition a thumbs down")
+	title := flags.String("title", "", "Title of the song")
+	artist := flags.String("artist", "", "Artist of the song")
+	prevTitle := flags.String("afterTitle", "", "Title of the song played before it, to rate the transition instead of the song")
+	prevArtist := flags.String("afterArtist", "", "Artist of the song played before it")
+	list := flags.Bool("list", false, "List the feedback you've given")
+	flags.Parse(arguments)
+
+	if *user == "" {
+		fmt.Println("feedback needs -lastFm. Use -help for details.")
+		os.Exit(2)
+	}
+	feedback, err := markov.ReadFeedback(*user)
+	if err != nil && !errors.Is(err, lastFm.ErrNotCached) {
+		// Carrying on would save over the feedback that couldn't be read.
+		fmt.Println("Couldn't read your feedback from the cache:", err)
+		os.Exit(1)
+	}
+
+	if *list {
+		printFeedback(feedback)
+		return
+	}
+	if *up == *down || *title == "" || *artist == "" {
+		fmt.Println("feedback needs one of -up or -down, along with -title and -artist.")
+		os.Exit(2)
+	}
+	song := lastFm.BaseSong{Artist: *artist, Title: *title}
+	if *prevTitle != "" {
+		prev := lastFm.BaseSong{Artist: *prevArtist, Title: *prevTitle}
+		feedback.RateTransition(markov.Transition{From: prev, To: song}, *up)
+	} else {
+		feedback.RateSong(song, *up)
+	}
+
+	if err = markov.WriteFeedback(*user, feedback); err != nil {
+		fmt.Println("Couldn't save your feedback:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Got it! That'll be taken into account the next time you make a playlist.")
+}
+
+// printFeedback lists every song and transition that's been rated.
+func printFeedback(feedback markov.Feedback) {
+	if len(feedback.Songs) == 0 && len(feedback.Transitions) == 0 {
+		fmt.Println("You haven't given any feedback yet.")
+		return
+	}
+	for song, votes := range feedback.Songs {
+		fmt.Printf("%+d  %s by %s\n", votes, song.Title, song.Artist)
+	}
+	for t, votes := range feedback.Transitions {
+		fmt.Printf("%+d  %s by %s, then %s by %s\n", votes, t.From.Title, t.From.Artist, t.To.Title, t.To.Artist)
+	}
+}
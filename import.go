@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/snyderks/spotkov/lastFm"
+)
+
+// maxImportErrors is how many unreadable rows are listed after an import.
+const maxImportErrors = 10
+
+// runImport adds an exported listening history to a user's cache.
+func runImport(arguments []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	user := flags.String("lastFm", "", "Your Last.FM User ID")
+	csvPath := flags.String("csv", "", "CSV export of your Last.FM scrobbles")
+	zone := flags.String("tz", "UTC", "Time zone of dates in the export that don't say, like America/New_York")
+	flags.Parse(arguments)
+
+	if *user == "" || *csvPath == "" {
+		fmt.Println("import needs -lastFm and -csv. Use -help for details.")
+		os.Exit(2)
+	}
+	loc, err := time.LoadLocation(*zone)
+	if err != nil {
+		fmt.Println("Couldn't find the time zone", *zone+":", err)
+		os.Exit(2)
+	}
+
+	f, err := os.Open(*csvPath)
+	if err != nil {
+		fmt.Println("Couldn't open the export:", err)
+		os.Exit(1)
+	}
+	songs, rowErrs := lastFm.ReadCSV(f, loc)
+	f.Close()
+	printImportErrors(rowErrs)
+	importSongs(*user, songs)
+}
+
+// printImportErrors lists the first few rows that couldn't be imported.
+func printImportErrors(rowErrs []error) {
+	if len(rowErrs) == 0 {
+		return
+	}
+	fmt.Println("Skipped", len(rowErrs), "entries that couldn't be read:")
+	for i, err := range rowErrs {
+		if i == maxImportErrors {
+			fmt.Println("  ...")
+			break
+		}
+		fmt.Println(" ", err)
+	}
+}
+
+// importSongs adds the songs to the user's cache and reports how it went.
+func importSongs(user string, songs []lastFm.Song) {
+	added, err := lastFm.ImportSongs(user, songs)
+	if err != nil {
+		fmt.Println("Couldn't save the imported songs:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Imported", added, "new scrobbles out of", len(songs), "in the export.")
+}
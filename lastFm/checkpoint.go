@@ -0,0 +1,81 @@
+package lastFm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// checkpointCachePrefix is the Redis key prefix for a user's Checkpoint.
+const checkpointCachePrefix = "checkpointCache."
+
+// checkpointPages is how many pages are fetched between saving progress.
+const checkpointPages = 50
+
+// errStaleCheckpoint is returned when the pages in a checkpoint's range
+// aren't the same as when it was saved, so it can't be carried on from.
+var errStaleCheckpoint = errors.New("The scrobbles changed since the fetch was interrupted")
+
+// Checkpoint is how far a fetch of a user's scrobbles has got. The range
+// is fixed when the fetch starts so that the pages stay the same if it's
+// interrupted and carried on later.
+type Checkpoint struct {
+	// From and To are the range of scrobbles being fetched, inclusive.
+	// A zero From means from the start of the user's history.
+	From, To time.Time
+	// Pages is how many pages there are in the range, and Scrobbles is
+	// how many songs there are on them.
+	Pages     int
+	Scrobbles int
+	// Done is how many pages have been fetched, counting back from the
+	// last one, which has the oldest scrobbles.
+	Done int
+}
+
+// newCheckpoint returns a checkpoint for fetching everything scrobbled
+// after the newest of songs, which are oldest first, up until now.
+func newCheckpoint(songs []Song, now time.Time) Checkpoint {
+	cp := Checkpoint{To: now.Truncate(time.Second)}
+	for i := len(songs) - 1; i >= 0; i-- {
+		if !songs[i].Timestamp.IsZero() && songs[i].Timestamp.Unix() > 0 {
+			cp.From = songs[i].Timestamp.Truncate(time.Second).Add(time.Second)
+			break
+		}
+	}
+	return cp
+}
+
+// readCheckpoint returns the user's checkpoint from an interrupted fetch,
+// if there is one.
+func readCheckpoint(userID string) (Checkpoint, bool) {
+	cp := Checkpoint{}
+	if err := ReadCache(userID, checkpointCachePrefix, &cp); err != nil || cp.To.IsZero() {
+		return Checkpoint{}, false
+	}
+	return cp, true
+}
+
+// clearCheckpoint removes the user's checkpoint once a fetch is finished.
+func clearCheckpoint(userID string) {
+	if UseRedis {
+		WriteCache(userID, checkpointCachePrefix, Checkpoint{})
+	}
+}
+
+// saveProgress caches the songs fetched so far along with the checkpoint
+// for carrying on from them.
+func saveProgress(userID string, songs []Song, uniques SongMap, cp Checkpoint) {
+	if !UseRedis {
+		return
+	}
+	err := cacheSongs(userID, songFile{songs})
+	if err == nil {
+		err = cacheUniqueSongs(userID, uniques)
+	}
+	if err == nil {
+		err = WriteCache(userID, checkpointCachePrefix, cp)
+	}
+	if err != nil {
+		fmt.Println("Couldn't save progress:", err.Error())
+	}
+}
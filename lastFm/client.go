@@ -0,0 +1,192 @@
+package lastFm
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Client makes requests to the Last.FM API. It's safe to use from multiple
+// goroutines, which share its connection pool and rate limit.
+type Client struct {
+	// HTTP is used to send every request.
+	HTTP *http.Client
+	// Timeout is how long one request can take before it's tried again.
+	Timeout time.Duration
+	// MaxRetries is how many times a request is tried again after a
+	// temporary error, like a timeout or being rate limited.
+	MaxRetries int
+	// MinBackoff is how long to wait before the first retry. The wait
+	// doubles after each retry up to MaxBackoff, with jitter added.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// RateLimitPause is how long all requests are held back after
+	// Last.FM says the rate limit was exceeded.
+	RateLimitPause time.Duration
+
+	limiter *rateLimiter
+}
+
+// DefaultClient is the client used to read songs from Last.FM.
+var DefaultClient = NewClient(5, 5)
+
+// NewClient returns a client that sends at most perSecond requests a
+// second on average, with bursts of up to burst requests. Last.FM asks for
+// no more than 5 requests a second.
+func NewClient(perSecond float64, burst int) *Client {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConns:        burst,
+		MaxIdleConnsPerHost: burst,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &Client{
+		HTTP:           &http.Client{Transport: transport},
+		Timeout:        10 * time.Second,
+		MaxRetries:     5,
+		MinBackoff:     500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+		RateLimitPause: 10 * time.Second,
+		limiter:        newRateLimiter(perSecond, burst),
+	}
+}
+
+// getPage requests a page of recent tracks. See get.
+func (c *Client) getPage(ctx context.Context, url string) (SongsPage, error) {
+	page := SongsPage{}
+	if err := c.get(ctx, url, &page); err != nil {
+		return SongsPage{}, err
+	}
+	return page, nil
+}
+
+// get requests url and decodes the response into v, waiting its turn under
+// the rate limit and trying again with backoff after temporary errors.
+func (c *Client) get(ctx context.Context, url string, v interface{}) error {
+	var err error
+	for try := 0; try <= c.MaxRetries; try++ {
+		if try > 0 {
+			if errors.Is(err, ErrRateLimited) {
+				c.limiter.pause(c.RateLimitPause)
+			}
+			if waitErr := sleep(ctx, c.backoff(try)); waitErr != nil {
+				return waitErr
+			}
+		}
+		if err = c.limiter.wait(ctx); err != nil {
+			return err
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, c.Timeout)
+		err = getJSON(reqCtx, c.HTTP, url, v)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !isTemporary(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// backoff returns how long to wait before the given retry: an exponentially
+// growing delay, of which a random half is left out so that requests that
+// failed together don't all retry together.
+func (c *Client) backoff(try int) time.Duration {
+	d := c.MinBackoff
+	for i := 1; i < try && d < c.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// sleep waits for d, or returns the context's error if it's cancelled first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// rateLimiter is a token bucket. Tokens are added at a steady rate up to
+// the size of the bucket, and each request takes one.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // size of the bucket
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perSecond float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   perSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens earned since the last refill.
+// l.mu must be held.
+func (l *rateLimiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// wait blocks until a token can be taken or the context is cancelled.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		l.refill()
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		d := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+		if err := sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// pause empties the bucket so that no requests are let through for d.
+func (l *rateLimiter) pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	if owed := -d.Seconds() * l.rate; l.tokens > owed {
+		l.tokens = owed
+	}
+}
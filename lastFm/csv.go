@@ -0,0 +1,230 @@
+package lastFm
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvColumns holds the position of each field in a row of a CSV export.
+// A position of -1 means the export doesn't have that field.
+type csvColumns struct {
+	artist     int
+	album      int
+	title      int
+	timestamp  int
+	mbid       int
+	artistMBID int
+	albumMBID  int
+}
+
+// defaultCSVColumns is the layout of exports without a header row, which
+// are artist, album, title, and date, in that order.
+var defaultCSVColumns = csvColumns{artist: 0, album: 1, title: 2, timestamp: 3, mbid: -1, artistMBID: -1, albumMBID: -1}
+
+// csvHeaders maps the column names used by export tools to fields.
+// Earlier names are preferred when an export has more than one, since
+// Unix times don't depend on a time zone.
+var csvHeaders = map[string][]string{
+	"artist":     {"artist", "artist_name", "artistname"},
+	"album":      {"album", "album_name", "albumname", "release"},
+	"title":      {"track", "title", "name", "track_name", "trackname", "song"},
+	"timestamp":  {"uts", "timestamp", "date_uts", "utc_time", "date", "time", "played_at"},
+	"mbid":       {"track_mbid", "mbid", "recording_mbid"},
+	"artistMBID": {"artist_mbid"},
+	"albumMBID":  {"album_mbid", "release_mbid"},
+}
+
+// csvTimeLayouts are the text date formats that export tools are known to use.
+var csvTimeLayouts = []string{
+	time.RFC3339,
+	"02 Jan 2006 15:04",
+	"2 Jan 2006 15:04",
+	"02 Jan 2006, 15:04",
+	"2 Jan 2006, 15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"01/02/2006 15:04",
+}
+
+// ReadCSV reads scrobbles from a CSV export of a Last.FM history.
+// Exports with a header row can have their columns in any order; without
+// one, the columns are expected to be artist, album, title, and date.
+// Dates can be Unix times or text, and text dates without a time zone are
+// read in loc (UTC if loc is nil).
+//
+// Rows that can't be read are skipped, and an error is returned for each
+// one alongside the songs that could be read. The songs are oldest first.
+func ReadCSV(r io.Reader, loc *time.Location) ([]Song, []error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1 // rows are checked one at a time instead.
+	reader.LazyQuotes = true
+
+	songs := make([]Song, 0)
+	rowErrs := make([]error, 0)
+	columns := defaultCSVColumns
+	for line := 1; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				rowErrs = append(rowErrs, err)
+				continue
+			}
+			return songs, append(rowErrs, err)
+		}
+		if line == 1 {
+			if header, ok := readCSVHeader(row); ok {
+				columns = header
+				continue
+			}
+		}
+		song, err := readCSVRow(row, columns, loc)
+		if err != nil {
+			rowErrs = append(rowErrs, fmt.Errorf("line %d: %s", line, err.Error()))
+			continue
+		}
+		songs = append(songs, song)
+	}
+	sortByTimestamp(songs)
+	return songs, rowErrs
+}
+
+// readCSVHeader works out the columns from a header row.
+// It returns false if the row doesn't look like a header.
+func readCSVHeader(row []string) (csvColumns, bool) {
+	names := make(map[string]int, len(row))
+	for i, name := range row {
+		names[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	find := func(field string) int {
+		for _, name := range csvHeaders[field] {
+			if i, ok := names[name]; ok {
+				return i
+			}
+		}
+		return -1
+	}
+	columns := csvColumns{
+		artist:     find("artist"),
+		album:      find("album"),
+		title:      find("title"),
+		timestamp:  find("timestamp"),
+		mbid:       find("mbid"),
+		artistMBID: find("artistMBID"),
+		albumMBID:  find("albumMBID"),
+	}
+	ok := columns.artist >= 0 && columns.title >= 0 && columns.timestamp >= 0
+	return columns, ok
+}
+
+// readCSVRow turns one row of an export into a song.
+func readCSVRow(row []string, columns csvColumns, loc *time.Location) (Song, error) {
+	field := func(i int) string {
+		if i < 0 || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+	song := Song{
+		Artist:     field(columns.artist),
+		Title:      field(columns.title),
+		Album:      field(columns.album),
+		MBID:       field(columns.mbid),
+		ArtistMBID: field(columns.artistMBID),
+		AlbumMBID:  field(columns.albumMBID),
+	}
+	if song.Artist == "" || song.Title == "" {
+		return Song{}, errors.New("the artist or title is missing")
+	}
+	ts, err := parseCSVTime(field(columns.timestamp), loc)
+	if err != nil {
+		return Song{}, err
+	}
+	song.Timestamp = ts
+	return song, nil
+}
+
+// parseCSVTime reads a Unix time, in seconds or milliseconds, or a date in
+// one of the known text formats.
+func parseCSVTime(s string, loc *time.Location) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, errors.New("the date is missing")
+	}
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		// anything this big has to be in milliseconds.
+		if unix > 1e11 {
+			return time.Unix(0, unix*int64(time.Millisecond)), nil
+		}
+		return time.Unix(unix, 0), nil
+	}
+	for _, layout := range csvTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("couldn't read the date " + s)
+}
+
+// ImportSongs adds songs from another source, such as a CSV export, to the
+// user's cached history. Songs that are already cached are left out, so
+// importing the same export twice doesn't duplicate anything.
+// Since the cache picks up after its newest song, only songs scrobbled
+// after the import are fetched the next time ReadLastFMSongs is called.
+// It returns how many songs were added.
+func ImportSongs(userID string, songs []Song) (int, error) {
+	if !UseRedis {
+		return 0, errors.New("Songs can only be imported into the cache, which isn't available.")
+	}
+	file := songFile{}
+	// a missing cache is fine; the import will be the whole history.
+	// Anything else would have the import overwrite what couldn't be read.
+	if err := readCachedSongs(userID, &file); err != nil && !errors.Is(err, ErrNotCached) {
+		return 0, err
+	}
+	var uniques SongMap
+	if err := ReadCachedUniqueSongs(userID, &uniques); err != nil && !errors.Is(err, ErrNotCached) {
+		return 0, err
+	}
+	if uniques.Songs == nil {
+		uniques.Songs = make(map[BaseSong]bool)
+	}
+
+	type scrobble struct {
+		BaseSong
+		unix int64
+	}
+	seen := make(map[scrobble]bool, len(file.Songs))
+	for _, song := range file.Songs {
+		seen[scrobble{BaseSong{song.Artist, song.Title}, song.Timestamp.Unix()}] = true
+	}
+	added := 0
+	for _, song := range songs {
+		s := scrobble{BaseSong{song.Artist, song.Title}, song.Timestamp.Unix()}
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		file.Songs = append(file.Songs, song)
+		uniques.Songs[s.BaseSong] = true
+		added++
+	}
+	sortByTimestamp(file.Songs)
+
+	if err := cacheSongs(userID, file); err != nil {
+		return 0, err
+	}
+	if err := cacheUniqueSongs(userID, uniques); err != nil {
+		return added, err
+	}
+	return added, nil
+}
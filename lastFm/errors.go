@@ -0,0 +1,78 @@
+package lastFm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Errors that can come back from reading songs from Last.FM.
+// Use errors.Is to check for them, since they're usually wrapped.
+var (
+	ErrMissingAPIKey      = errors.New("No Last.FM API key was found in LASTFM_KEY or config.json")
+	ErrInvalidAPIKey      = errors.New("Last.FM didn't accept the API key")
+	ErrUserNotFound       = errors.New("Last.FM couldn't find that user")
+	ErrRateLimited        = errors.New("Last.FM's rate limit was exceeded")
+	ErrServiceUnavailable = errors.New("Last.FM is unavailable right now")
+	ErrMalformedResponse  = errors.New("Last.FM sent a response that couldn't be read")
+)
+
+// APIError contains the format of an error received if something
+// went wrong during an API call. It unwraps to one of the errors above
+// when there's one that matches the code.
+type APIError struct {
+	Code    int    `json:"error"`
+	Message string `json:"message"`
+}
+
+// Error codes from https://www.last.fm/api/errorcodes
+const (
+	codeInvalidParameters = 6
+	codeOperationFailed   = 8
+	codeInvalidAPIKey     = 10
+	codeServiceOffline    = 11
+	codeTemporaryError    = 16
+	codeSuspendedAPIKey   = 26
+	codeRateLimitExceeded = 29
+)
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("Last.FM returned error %d: %s", e.Code, e.Message)
+}
+
+// Unwrap returns the error matching the code, or nil if there isn't one.
+func (e *APIError) Unwrap() error {
+	switch e.Code {
+	case codeInvalidParameters:
+		// This is what comes back for a user that doesn't exist,
+		// since the user is the only parameter that comes from outside.
+		return ErrUserNotFound
+	case codeInvalidAPIKey, codeSuspendedAPIKey:
+		return ErrInvalidAPIKey
+	case codeRateLimitExceeded:
+		return ErrRateLimited
+	case codeOperationFailed, codeServiceOffline, codeTemporaryError:
+		return ErrServiceUnavailable
+	}
+	return nil
+}
+
+// decodeResponse reads the body of a response into v, returning an
+// *APIError if Last.FM sent one instead.
+func decodeResponse(body []byte, v interface{}) error {
+	apiErr := APIError{}
+	if err := json.Unmarshal(body, &apiErr); err == nil && apiErr.Code != 0 {
+		return &apiErr
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%w: %s", ErrMalformedResponse, err.Error())
+	}
+	return nil
+}
+
+// isTemporary reports whether a request that failed with err
+// might work if it's tried again.
+func isTemporary(err error) bool {
+	return !errors.Is(err, ErrInvalidAPIKey) && !errors.Is(err, ErrUserNotFound) &&
+		!errors.Is(err, ErrMissingAPIKey)
+}
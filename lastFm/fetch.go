@@ -0,0 +1,237 @@
+package lastFm
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultWorkers is how many pages are fetched at once if FetchOptions
+// doesn't say otherwise.
+const DefaultWorkers = 8
+
+// pageLimit is how many scrobbles are asked for on each page.
+// This is the most Last.FM allows.
+const pageLimit = 200
+
+// FetchOptions control how songs are fetched from Last.FM.
+// The zero value uses DefaultClient and DefaultWorkers.
+type FetchOptions struct {
+	// Client sends the requests.
+	Client *Client
+	// Workers is how many pages are fetched at once.
+	Workers int
+	// Progress is called after each page is handled with how many of the
+	// pages are done, if it isn't nil.
+	Progress func(done, total int)
+}
+
+func (o FetchOptions) client() *Client {
+	if o.Client == nil {
+		return DefaultClient
+	}
+	return o.Client
+}
+
+func (o FetchOptions) workers() int {
+	if o.Workers < 1 {
+		return DefaultWorkers
+	}
+	return o.Workers
+}
+
+// apiURL returns the URL for calling an API method with the given
+// parameters, which can be nil.
+func apiURL(method string, params url.Values) (string, error) {
+	key, err := apiKey()
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	for name, values := range params {
+		query[name] = values
+	}
+	query.Set("method", method)
+	query.Set("api_key", key)
+	query.Set("format", "json")
+	return baseLastURI + "?" + query.Encode(), nil
+}
+
+// recentTracksURL returns the URL for the user's scrobbles from from until
+// to, inclusive, with limit songs on each page. Zero times leave the range
+// open at that end.
+func recentTracksURL(userID string, from, to time.Time, limit int) (string, error) {
+	query := url.Values{}
+	query.Set("user", userID)
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("extended", "1")
+	if !from.IsZero() {
+		query.Set("from", strconv.FormatInt(from.Unix(), 10))
+	}
+	if !to.IsZero() {
+		query.Set("to", strconv.FormatInt(to.Unix(), 10))
+	}
+	return apiURL("user.getrecenttracks", query)
+}
+
+// fetchRange fetches the user's scrobbles in cp's range and passes them to
+// handle oldest first, a page at a time, along with how far it's got. The
+// cp.Done pages that were fetched before are skipped. It returns how many
+// scrobbles Last.FM said there were in the range.
+func fetchRange(ctx context.Context, opts FetchOptions, userID string, cp Checkpoint, handle func(songs []Song, cp Checkpoint)) (int, error) {
+	last_url, err := recentTracksURL(userID, cp.From, cp.To, pageLimit)
+	if err != nil {
+		return 0, err
+	}
+	songs, err := opts.client().getPage(ctx, last_url)
+	if err != nil {
+		return 0, err
+	}
+
+	max_page, _ := strconv.Atoi(songs.RecentTracks.Metadata.TotalPages)
+	total, _ := strconv.Atoi(songs.RecentTracks.Metadata.TotalSongs)
+	if max_page < 1 {
+		max_page = 1
+	}
+	// The pages are only the same as last time if nothing in the range
+	// changed, which is why the end of the range is pinned.
+	if cp.Done > 0 && (max_page != cp.Pages || total != cp.Scrobbles || cp.Done >= max_page) {
+		return 0, errStaleCheckpoint
+	}
+	cp.Pages = max_page
+	cp.Scrobbles = total
+
+	handlePage := func(songs []Song) {
+		cp.Done++
+		handle(songs, cp)
+		if opts.Progress != nil {
+			opts.Progress(cp.Done, cp.Pages)
+		}
+	}
+
+	// Page 1 has the newest songs, so the rest are fetched from the last
+	// page back so they can be handled in order as they come in.
+	pages := make([]int, 0, max_page)
+	for i := max_page - cp.Done; i > 1; i-- {
+		pages = append(pages, i)
+	}
+	if err = fetchPages(ctx, opts, last_url, pages, handlePage); err != nil {
+		return 0, err
+	}
+	handlePage(pageSongs(songs))
+	return total, nil
+}
+
+// fetchedPage is a page of songs, or why it couldn't be fetched.
+type fetchedPage struct {
+	page  int
+	songs []Song
+	err   error
+}
+
+// fetchPages fetches the given pages of url with a pool of workers and
+// passes the songs on each one to handle in the same order as pages, even
+// though they may arrive out of order. It stops and returns the error
+// of the first page that fails.
+func fetchPages(ctx context.Context, opts FetchOptions, url string, pages []int, handle func(songs []Song)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var workersWg sync.WaitGroup
+	defer func() {
+		cancel()
+		workersWg.Wait()
+	}()
+
+	jobs := make(chan int)
+	results := make(chan fetchedPage)
+	go func() {
+		defer close(jobs)
+		for _, page := range pages {
+			select {
+			case jobs <- page:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	client := opts.client()
+	for i := 0; i < opts.workers(); i++ {
+		workersWg.Add(1)
+		go func() {
+			defer workersWg.Done()
+			for page := range jobs {
+				songs, err := client.getPage(ctx, url+"&page="+strconv.Itoa(page))
+				if err != nil && ctx.Err() == nil {
+					err = fmt.Errorf("Couldn't retrieve page %d of the scrobbles: %w", page, err)
+				}
+				result := fetchedPage{page: page, songs: pageSongs(songs), err: err}
+				select {
+				case results <- result:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// Pages that arrive early wait here until the ones before them are in.
+	waiting := make(map[int]fetchedPage)
+	for next := 0; next < len(pages); {
+		var result fetchedPage
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if result.err != nil {
+			return result.err
+		}
+		waiting[result.page] = result
+		for next < len(pages) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			ready, ok := waiting[pages[next]]
+			if !ok {
+				break
+			}
+			delete(waiting, pages[next])
+			handle(ready.songs)
+			next++
+		}
+	}
+	return nil
+}
+
+// pageSongs returns the scrobbled songs in a page, oldest first.
+func pageSongs(page SongsPage) []Song {
+	tracks := page.RecentTracks.Tracks
+	// We don't want the currently playing track there. This checks for that.
+	if len(tracks) > 0 && tracks[0].nowPlaying() {
+		tracks = tracks[1:]
+	}
+	// Tracks are newest first, so go backwards.
+	songs := make([]Song, 0, len(tracks))
+	for i := len(tracks) - 1; i >= 0; i-- {
+		track := tracks[i]
+		utime, err := strconv.ParseInt(track.Timestamp.UnixTime, 10, 64)
+		var ts time.Time
+		if err == nil {
+			ts = time.Unix(utime, 0)
+		}
+		songs = append(songs, Song{
+			Artist:     track.Artist.name(),
+			Title:      track.Title,
+			Timestamp:  ts,
+			Album:      track.Album.Title,
+			MBID:       track.MBID,
+			ArtistMBID: track.Artist.MBID,
+			AlbumMBID:  track.Album.MBID,
+			Loved:      track.Loved == "1",
+		})
+	}
+	return songs
+}
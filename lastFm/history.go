@@ -0,0 +1,85 @@
+package lastFm
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// HistorySource is somewhere a user's listening history can be read from.
+type HistorySource interface {
+	// History returns every song the user has played, oldest first,
+	// along with when each one was played.
+	History(ctx context.Context, userID string) ([]Song, error)
+}
+
+// RangedHistorySource is a HistorySource that can read part of a user's
+// history without reading all of it.
+type RangedHistorySource interface {
+	HistorySource
+	// HistoryBetween returns the songs the user played from from up to,
+	// but not including, to, oldest first. A zero time leaves the range
+	// open at that end.
+	HistoryBetween(ctx context.Context, userID string, from, to time.Time) ([]Song, error)
+}
+
+// HistoryBetween returns the songs the user played from from up to, but
+// not including, to, oldest first. A zero time leaves the range open at
+// that end. Sources that can read just the range are asked for it, and
+// the rest have their whole history read and trimmed to it.
+func HistoryBetween(ctx context.Context, source HistorySource, userID string, from, to time.Time) ([]Song, error) {
+	if from.IsZero() && to.IsZero() {
+		return source.History(ctx, userID)
+	}
+	if ranged, ok := source.(RangedHistorySource); ok {
+		return ranged.HistoryBetween(ctx, userID, from, to)
+	}
+	songs, err := source.History(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return Between(songs, from, to), nil
+}
+
+// Between returns the songs played from from up to, but not including,
+// to, in the same order. A zero time leaves the range open at that end.
+func Between(songs []Song, from, to time.Time) []Song {
+	between := make([]Song, 0)
+	for _, song := range songs {
+		if song.Timestamp.Before(from) || (!to.IsZero() && !song.Timestamp.Before(to)) {
+			continue
+		}
+		between = append(between, song)
+	}
+	return between
+}
+
+// LastFMSource reads listening history from Last.FM, using the cache to
+// only fetch songs scrobbled since the last time.
+type LastFMSource struct {
+	Options FetchOptions
+}
+
+// History returns the user's scrobbles. See ReadLastFMSongsWithOptions.
+func (s LastFMSource) History(ctx context.Context, userID string) ([]Song, error) {
+	return ReadLastFMSongsWithOptions(ctx, userID, s.Options)
+}
+
+// HistoryBetween returns the user's scrobbles in a range.
+// See ReadLastFMSongsBetween.
+func (s LastFMSource) HistoryBetween(ctx context.Context, userID string, from, to time.Time) ([]Song, error) {
+	return ReadLastFMSongsBetween(ctx, userID, from, to, s.Options)
+}
+
+// MemorySource is a HistorySource that holds each user's history in memory.
+// It's mostly useful for testing.
+type MemorySource map[string][]Song
+
+// History returns the songs stored for the user.
+func (m MemorySource) History(ctx context.Context, userID string) ([]Song, error) {
+	songs, ok := m[userID]
+	if !ok {
+		return nil, errors.New("No history is stored for " + userID + ".")
+	}
+	return songs, nil
+}
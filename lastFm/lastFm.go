@@ -2,17 +2,15 @@
 package lastFm
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"strconv"
+	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -42,11 +40,14 @@ type metadata struct {
 }
 
 // track holds all information about the song retrieved.
+// Loved is only sent when extended information is asked for.
 type track struct {
 	Artist     artist                 `json:"artist"`
 	Title      string                 `json:"name"`
+	MBID       string                 `json:"mbid"`
 	Album      album                  `json:"album"`
 	Timestamp  trackDate              `json:"date"`
+	Loved      string                 `json:"loved"`
 	Attributes map[string]interface{} `json:"@attr"`
 }
 
@@ -58,22 +59,43 @@ type trackDate struct {
 	TextDate string `json:"#text"`
 }
 
-// artist is the name of an artist.
+// artist is the name of an artist. Extended information has the name
+// in Name instead of Title.
 type artist struct {
 	Title string `json:"#text"`
+	Name  string `json:"name"`
+	MBID  string `json:"mbid"`
+}
+
+// name returns the artist's name from whichever field it's in.
+func (a artist) name() string {
+	if a.Title != "" {
+		return a.Title
+	}
+	return a.Name
 }
 
 // album is the name of an album.
 type album struct {
 	Title string `json:"#text"`
+	MBID  string `json:"mbid"`
 }
 
 // Song has an artist name, the title of the song, and when the song
-// was scrobbled by the user.
+// was scrobbled by the user. The rest is only filled in when the source
+// of the song has it. MBIDs are MusicBrainz IDs.
+//
+// Fields can be added here without breaking the cache, since gob leaves
+// ones that weren't stored empty.
 type Song struct {
-	Artist    string
-	Title     string
-	Timestamp time.Time
+	Artist     string
+	Title      string
+	Timestamp  time.Time
+	Album      string
+	MBID       string
+	ArtistMBID string
+	AlbumMBID  string
+	Loved      bool
 }
 
 // BaseSong has an artist name and the title of the song.
@@ -92,13 +114,6 @@ type SongMap struct {
 	Songs map[BaseSong]bool
 }
 
-// lastFMError contains the format of an error received if something
-// went wrong during an API call.
-type lastFMError struct {
-	Error   int    `json:"error"`
-	Message string `json:"message"`
-}
-
 // Redis key prefixes for reading and writing song data.
 const allSongCachePrefix = "songCache."
 const uniqueCachePrefix = "uniqueCache."
@@ -133,10 +148,24 @@ func init() {
 	}
 }
 
+// ErrNotCached is returned by ReadCache when nothing has been cached under
+// the key yet. Any other error means the cache couldn't be read, and
+// shouldn't be overwritten as if it were empty.
+var ErrNotCached = errors.New("Nothing has been cached for that user yet.")
+
+// cacheGet and cacheSet get and set a key in Redis. Tests replace them.
+var cacheGet = func(key string) (string, error) { return c.Get(key).Result() }
+var cacheSet = func(key, value string) error { return c.Set(key, value, 0).Err() }
+
+// ReadCache reads what's cached for the user under cachePrefix into songs.
+// It returns ErrNotCached if nothing is.
 func ReadCache(userID string, cachePrefix string, songs interface{}) error {
 	if UseRedis {
 		// Send the command to retrieve the cache to Redis.
-		s, err := c.Get(cachePrefix + userID).Result()
+		s, err := cacheGet(cachePrefix + userID)
+		if err == redis.Nil {
+			return ErrNotCached
+		}
 		if err != nil {
 			return errors.New(fmt.Sprintf("Error occurred in Redis request: %s", err.Error()))
 		}
@@ -159,7 +188,7 @@ func WriteCache(userID string, cachePrefix string, songs interface{}) error {
 		if err != nil {
 			return errors.New(fmt.Sprintf("Error encoding the SongMap: %s", err.Error()))
 		}
-		err = c.Set(cachePrefix+userID, b64, 0).Err()
+		err = cacheSet(cachePrefix+userID, b64)
 		if err != nil {
 			return errors.New(fmt.Sprintf("Error sending the SET request to Redis: %s", err.Error()))
 		}
@@ -173,6 +202,16 @@ func ReadCachedUniqueSongs(userID string, songs *SongMap) error {
 	return ReadCache(userID, uniqueCachePrefix, songs)
 }
 
+// ReadCachedSongs returns every song cached for a user, oldest first,
+// without asking Last.FM for any new ones.
+func ReadCachedSongs(userID string) ([]Song, error) {
+	file := songFile{}
+	if err := readCachedSongs(userID, &file); err != nil {
+		return nil, err
+	}
+	return file.Songs, nil
+}
+
 // readCachedSongs reads any existing song data about a user and
 // stores that data into the songs argument.
 func readCachedSongs(userID string, songs *songFile) error {
@@ -190,15 +229,28 @@ func cacheUniqueSongs(userID string, songs SongMap) error {
 	return WriteCache(userID, uniqueCachePrefix, songs)
 }
 
-// pagesWg manages the number of pages currently being searched for.
-var pagesWg sync.WaitGroup
-
 // baseLastURI is the root of the API path for Last.FM.
-const baseLastURI = "http://ws.audioscrobbler.com/2.0/"
+// It's only changed by tests.
+var baseLastURI = "http://ws.audioscrobbler.com/2.0/"
 
-// ReadLastFMSongs retrieves all scrobbled Last.FM songs for a specific user.
+// ReadLastFMSongs retrieves all scrobbled Last.FM songs for a specific user,
+// oldest first.
 // Returns an error on failure.
 func ReadLastFMSongs(userID string) ([]Song, error) {
+	return ReadLastFMSongsContext(context.Background(), userID)
+}
+
+// ReadLastFMSongsContext is like ReadLastFMSongs, but stops fetching from
+// Last.FM and returns the context's error if it's cancelled first.
+// The songs fetched until then are cached, and the next call carries on
+// from there.
+func ReadLastFMSongsContext(ctx context.Context, userID string) ([]Song, error) {
+	return ReadLastFMSongsWithOptions(ctx, userID, FetchOptions{})
+}
+
+// ReadLastFMSongsWithOptions is like ReadLastFMSongsContext, but fetches
+// the songs the way opts says to.
+func ReadLastFMSongsWithOptions(ctx context.Context, userID string, opts FetchOptions) ([]Song, error) {
 	var uniques SongMap
 	err := ReadCachedUniqueSongs(userID, &uniques)
 
@@ -212,28 +264,27 @@ func ReadLastFMSongs(userID string) ([]Song, error) {
 	file := songFile{}
 	err = readCachedSongs(userID, &file)
 	titlesConcat := file.Songs
-	if len(titlesConcat) == 0 {
-		err = errors.New("Length of cached songs is 0. Regenerating...")
+	if err != nil || len(titlesConcat) == 0 { // couldn't retrieve a cached version
+		titlesConcat = make([]Song, 0)
 	}
+	// Older caches might not be in order.
+	sortByTimestamp(titlesConcat)
 
-	var errLastFM lastFMError
-
-	if err != nil { // couldn't retrieve a cached version
-		titlesConcat, errLastFM = getAllTitles(make([]Song, 0), &uniques, time.Time{}, userID)
-	} else {
-		var lastDate time.Time
-		for _, song := range titlesConcat {
-			if !song.Timestamp.IsZero() {
-				lastDate = song.Timestamp
-				break
-			}
-		}
-		titlesConcat, errLastFM = getAllTitles(titlesConcat, &uniques, lastDate, userID)
+	// Pick up an interrupted fetch if there was one.
+	cp, resuming := readCheckpoint(userID)
+	if !resuming || len(titlesConcat) == 0 {
+		cp = newCheckpoint(titlesConcat, time.Now())
 	}
-
-	if errLastFM.Error != 0 {
-		return nil, errors.New("Generating the playlist failed. Please try again with the same or a different song.")
+	newTitles, err := getAllTitles(ctx, opts, titlesConcat, &uniques, cp, userID)
+	if errors.Is(err, errStaleCheckpoint) {
+		// Scrobbles changed since then, so start over from what's cached.
+		cp = newCheckpoint(titlesConcat, time.Now())
+		newTitles, err = getAllTitles(ctx, opts, titlesConcat, &uniques, cp, userID)
 	}
+	if err != nil {
+		return nil, err
+	}
+	titlesConcat = newTitles
 
 	err = cacheSongs(userID, songFile{titlesConcat})
 	if err != nil {
@@ -248,6 +299,7 @@ func ReadLastFMSongs(userID string) ([]Song, error) {
 		// See above. Don't want to return an error.
 		err = nil
 	}
+	clearCheckpoint(userID)
 
 	if len(titlesConcat) == 0 {
 		err = errors.New("Failed to retrieve any play history. Please try again.")
@@ -257,219 +309,144 @@ func ReadLastFMSongs(userID string) ([]Song, error) {
 
 }
 
-// getAllTitles takes a list of songs and returns the songs for the user scrobbled after a certain time.
-// Returns an error if something goes wrong.
-func getAllTitles(titles []Song, uniques *SongMap, startTime time.Time, user_id string) (newTitles []Song, errLastFM lastFMError) {
-	defer func() {
-		if r := recover(); r != nil {
-			errLastFM.Error = r.(int)
-			errLastFM.Message = r.(string)
-			newTitles = make([]Song, 0)
-		}
-	}()
-	// try to do things with last.fm
-	method := "user.getrecenttracks"
-	api_key, key_success := os.LookupEnv("LASTFM_KEY")
-	get_json := true
-	if key_success == false {
-		config, err := configRead.Read("config.json")
-		if err != nil {
-			panic("Couldn't read config or get env vars")
-		} else {
-			api_key = config.LastFmKey
-		}
-	}
-	urlTime := "0"
-	if !startTime.IsZero() {
-		timeInt := startTime.UTC().Unix()
-		if timeInt > 0 {
-			urlTime = strconv.FormatInt(timeInt+1, 10)
-		}
+// ReadLastFMSongsBetween returns the user's scrobbles from from up to, but
+// not including, to, oldest first. A zero time leaves the range open at
+// that end.
+//
+// The cache is used when it already has the whole range. When the range
+// starts within the cache, the cache is brought up to date the same way
+// ReadLastFMSongsWithOptions does. Otherwise only the range is fetched from
+// Last.FM, and it isn't cached, since the cache has to start from the
+// first scrobble.
+func ReadLastFMSongsBetween(ctx context.Context, userID string, from, to time.Time, opts FetchOptions) ([]Song, error) {
+	file := songFile{}
+	if err := readCachedSongs(userID, &file); err != nil {
+		file.Songs = nil
 	}
-	last_url := baseLastURI + "?method=" + method + "&user=" + user_id + "&api_key=" + api_key +
-		"&limit=200" + "&from=" + urlTime
-	if get_json {
-		last_url += "&format=json"
+	cached := file.Songs
+	sortByTimestamp(cached)
+
+	var last time.Time
+	if len(cached) > 0 {
+		last = cached[len(cached)-1].Timestamp
 	}
-	resp, err := http.Get(last_url)
-	var songsJSON []byte
-	if err == nil {
-		songsJSON, err = ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
+	switch {
+	case len(cached) > 0 && !to.IsZero() && !to.After(last):
+		return Between(cached, from, to), nil
+	case from.IsZero() || (len(cached) > 0 && !from.After(last)):
+		songs, err := ReadLastFMSongsWithOptions(ctx, userID, opts)
 		if err != nil {
-			log.Fatal("Couldn't read the body of the last.fm response")
+			return nil, err
 		}
-	} else {
-		fmt.Println(err)
+		return Between(songs, from, to), nil
 	}
 
-	songs := SongsPage{}
-	err = json.Unmarshal(songsJSON, &songs)
-	// We don't want the currently playing track there. This checks for that.
-	containsNowPlaying := false
-	if len(songs.RecentTracks.Tracks) > 0 {
-		if songs.RecentTracks.Tracks[0].Attributes != nil &&
-			songs.RecentTracks.Tracks[0].Attributes["nowplaying"].(string) == "true" {
-			containsNowPlaying = true
-		}
-	}
-	if containsNowPlaying {
-		songs.RecentTracks.Tracks = songs.RecentTracks.Tracks[1:]
+	cp := Checkpoint{From: from.Truncate(time.Second), To: time.Now().Truncate(time.Second)}
+	if !to.IsZero() && to.Before(cp.To) {
+		// Last.FM includes the end of the range, and this doesn't.
+		cp.To = to.Add(-time.Nanosecond).Truncate(time.Second)
 	}
-	topIndex := len(songs.RecentTracks.Tracks) - 1
-	for i := topIndex; i >= 0; i-- {
-		if topIndex-i != i {
-			temp := songs.RecentTracks.Tracks[i]
-			songs.RecentTracks.Tracks[i] = songs.RecentTracks.Tracks[topIndex-i]
-			songs.RecentTracks.Tracks[topIndex-i] = temp
-		}
-	}
-	pageSongs := make([]Song, 0, 50)
-
-	for _, track := range songs.RecentTracks.Tracks {
-		utime, err := strconv.ParseInt(track.Timestamp.UnixTime, 10, 64)
-		var ts time.Time
-		if err == nil {
-			ts = time.Unix(utime, 0)
-		}
-		pageSongs = append(pageSongs, Song{track.Artist.Title, track.Title, ts})
+	songs := make([]Song, 0)
+	_, err := fetchRange(ctx, opts, userID, cp, func(page []Song, _ Checkpoint) {
+		songs = append(songs, page...)
+	})
+	if err != nil {
+		return nil, err
 	}
+	return Between(songs, from, to), nil
+}
 
-	max_page, _ := strconv.Atoi(songs.RecentTracks.Metadata.TotalPages)
-
-	if max_page < 1 {
-		max_page = 1
-	}
+// sortByTimestamp puts songs in the order they were scrobbled, oldest first.
+// Songs scrobbled at the same time keep their order.
+func sortByTimestamp(songs []Song) {
+	sort.SliceStable(songs, func(i, j int) bool {
+		return songs[i].Timestamp.Before(songs[j].Timestamp)
+	})
+}
 
-	songPages := make([][]Song, max_page)
-
-	songPages[0] = pageSongs
-
-	batchAmt := 100
-
-	if max_page > batchAmt { // have to batch to avoid socket overload
-		for i := 0; i <= max_page/batchAmt; i++ {
-			var maxBatch int
-			if (i+1)*batchAmt > max_page {
-				maxBatch = max_page
-			} else {
-				maxBatch = (i + 1) * batchAmt
-			}
-			if i == 0 {
-				for j := 2; j <= maxBatch; j++ {
-					pagesWg.Add(1)
-					go getLastFMPagesAsync(last_url, j, maxBatch, songPages)
-				}
-			} else {
-				for j := i*batchAmt + 1; j <= maxBatch; j++ {
-					pagesWg.Add(1)
-					go getLastFMPagesAsync(last_url, j, maxBatch, songPages)
-				}
-			}
-			pagesWg.Wait()
+// getAllTitles takes a list of songs and returns them along with the
+// user's scrobbles in cp's range. Progress is saved to the cache every
+// checkpointPages pages and when something goes wrong, so that a later call
+// can carry on from cp.
+// Returns an error if something goes wrong or the context is cancelled.
+func getAllTitles(ctx context.Context, opts FetchOptions, titles []Song, uniques *SongMap, cp Checkpoint, user_id string) ([]Song, error) {
+	saved := cp
+	total, err := fetchRange(ctx, opts, user_id, cp, func(songs []Song, progress Checkpoint) {
+		// Everything in the pages was scrobbled after the songs
+		// already in titles.
+		titles = append(titles, songs...)
+		for _, el := range songs {
+			uniques.Songs[BaseSong{Artist: el.Artist, Title: el.Title}] = true
+		}
+		cp = progress
+		if cp.Done-saved.Done >= checkpointPages && cp.Done < cp.Pages {
+			saveProgress(user_id, titles, *uniques, cp)
+			saved = cp
 		}
-	} else {
-		for i := 2; i <= max_page; i++ {
-			pagesWg.Add(1)
-			go getLastFMPagesAsync(last_url, i, max_page, songPages)
+	})
+	if err != nil {
+		if cp.Done > saved.Done {
+			saveProgress(user_id, titles, *uniques, cp)
 		}
-		pagesWg.Wait()
+		return nil, err
 	}
 
-	// reversing all of the pages
-	topIndex = len(songPages) - 1
-	for i := topIndex; i >= 0; i-- {
-		if topIndex-i != i {
-			temp := songPages[i]
-			songPages[i] = songPages[topIndex-i]
-			songPages[topIndex-i] = temp
+	fetched := 0
+	for _, song := range titles {
+		if !song.Timestamp.Before(cp.From) && !song.Timestamp.After(cp.To) {
+			fetched++
 		}
 	}
-	if !startTime.IsZero() && len(titles) > 0 {
-		// normal append for a new list
-		for i := 0; i < max_page; i++ {
-			titles = append(songPages[i], titles...)
-			for _, el := range songPages[i] {
-				s := BaseSong{Artist: el.Artist, Title: el.Title}
-				if !uniques.Songs[s] {
-					uniques.Songs[s] = true
-				}
-			}
-		}
-	} else {
-		// if we're adding to the cache, have to prepend the new songs
-		for i := 0; i < max_page; i++ {
-			titles = append(titles, songPages[i]...)
-			for _, el := range songPages[i] {
-				s := BaseSong{Artist: el.Artist, Title: el.Title}
-				if !uniques.Songs[s] {
-					uniques.Songs[s] = true
-				}
-			}
-		}
+	if fetched < total {
+		fmt.Println("Last.FM has", total, "new scrobbles, but only", fetched,
+			"were downloaded. Run 'spotkov sync -verify' to find the rest.")
 	}
-
-	return titles, lastFMError{}
+	return titles, nil
 }
 
-// getLastFMPagesAsync populates allTitles with lists of lists of songs.
-// Fully encapsulates all async work.
-func getLastFMPagesAsync(url string, page int, max_page int, allTitles [][]Song) {
-	defer pagesWg.Done()
-	pageStr := strconv.Itoa(page)
-	songs := SongsPage{}
-	rateLimited := true
-	tries := 0
-	for rateLimited == true && tries < 4 {
-		tr := &http.Transport{
-			DisableKeepAlives: true,
-		}
-		c := &http.Client{Transport: tr, Timeout: 5 * time.Second}
-		resp, err := c.Get(url + "&page=" + pageStr)
-		if err == nil && resp.StatusCode == http.StatusOK {
-			songsJSON, err := ioutil.ReadAll(resp.Body)
-			resp.Body.Close()
-			err = json.Unmarshal(songsJSON, &songs)
-			if err != nil {
-				rateLimited = true
-				tries = tries + 1
-			} else {
-				rateLimited = false
-			}
-		}
+// apiKey returns the Last.FM API key from the environment or the config file.
+func apiKey() (string, error) {
+	key, ok := os.LookupEnv("LASTFM_KEY")
+	if ok && key != "" {
+		return key, nil
 	}
-
-	var tracksRaw []track
-	// Eliminate currently playing track if returned.
-	containsNowPlaying := false
-	if len(songs.RecentTracks.Tracks) > 0 {
-		if songs.RecentTracks.Tracks[0].Attributes != nil &&
-			songs.RecentTracks.Tracks[0].Attributes["nowplaying"].(string) == "true" {
-			containsNowPlaying = true
-		}
+	config, err := configRead.Read("config.json")
+	if err != nil || config.LastFmKey == "" {
+		return "", ErrMissingAPIKey
 	}
-	if containsNowPlaying {
-		tracksRaw = songs.RecentTracks.Tracks[1:]
-	} else {
-		tracksRaw = songs.RecentTracks.Tracks
+	return config.LastFmKey, nil
+}
+
+// nowPlaying reports whether the track is the one currently playing,
+// rather than one that's been scrobbled.
+func (t track) nowPlaying() bool {
+	playing, _ := t.Attributes["nowplaying"].(string)
+	return playing == "true"
+}
+
+// getJSON requests url from Last.FM once and decodes the response into v.
+// The request is abandoned if the context is cancelled.
+// Use Client.get to respect the rate limit and retry on failure.
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
 	}
-	// Reverse the array so that the suffixes are built in the right order.
-	topIndex := len(tracksRaw) - 1
-	for i := topIndex; i >= 0; i-- {
-		if topIndex-i != i {
-			temp := tracksRaw[i]
-			tracksRaw[i] = tracksRaw[topIndex-i]
-			tracksRaw[topIndex-i] = temp
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
+		return err
 	}
-	titles := make([]Song, 0)
-	for _, track := range tracksRaw {
-		utime, err := strconv.ParseInt(track.Timestamp.UnixTime, 10, 64)
-		var ts time.Time
-		if err == nil {
-			ts = time.Unix(utime, 0)
-		}
-		titles = append(titles, Song{track.Artist.Title, track.Title, ts})
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrMalformedResponse, err.Error())
+	}
+	err = decodeResponse(body, v)
+	if err != nil && resp.StatusCode >= http.StatusInternalServerError && errors.Is(err, ErrMalformedResponse) {
+		return fmt.Errorf("%w: %s", ErrServiceUnavailable, resp.Status)
 	}
-	allTitles[page-1] = titles
+	return err
 }
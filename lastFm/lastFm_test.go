@@ -1,6 +1,24 @@
 package lastFm
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/snyderks/spotkov/tools"
+)
 
 func TestSongMapCaching(t *testing.T) {
 	// create a very basic test object
@@ -41,3 +59,804 @@ func TestSongMapReading(t *testing.T) {
 		t.Error("The returned cache didn't contain the correct item.")
 	}
 }
+
+// TestMemorySource checks that an in-memory history source returns the
+// songs stored for a user and an error for anyone else.
+func TestMemorySource(t *testing.T) {
+	songs := []Song{{Artist: "Muse", Title: "Madness", Timestamp: time.Unix(100, 0)}}
+	var source HistorySource = MemorySource{"test": songs}
+
+	history, err := source.History(context.Background(), "test")
+	if err != nil || len(history) != 1 || history[0] != songs[0] {
+		t.Error("Didn't get the stored history back:", history, err)
+	}
+	if _, err = source.History(context.Background(), "someone else"); err == nil {
+		t.Error("No error was returned for a user without history.")
+	}
+}
+
+// TestSortByTimestamp checks that songs are put in the order they were
+// scrobbled.
+func TestSortByTimestamp(t *testing.T) {
+	songs := []Song{
+		{Title: "third", Timestamp: time.Unix(300, 0)},
+		{Title: "first", Timestamp: time.Unix(100, 0)},
+		{Title: "second", Timestamp: time.Unix(200, 0)},
+	}
+	sortByTimestamp(songs)
+	for i, title := range []string{"first", "second", "third"} {
+		if songs[i].Title != title {
+			t.Error("Expected", title, "at", i, "but got", songs[i].Title)
+		}
+	}
+}
+
+// TestReadCSV reads exports with and without a header row, skipping rows
+// that can't be read.
+func TestReadCSV(t *testing.T) {
+	withHeader := `uts,utc_time,artist,artist_mbid,album,album_mbid,track,track_mbid
+1500000100,"14 Jul 2017, 02:41",Radiohead,,OK Computer,,Lucky,
+1500000000,"14 Jul 2017, 02:40",Muse,fd857293,The Resistance,,Uprising,
+not a time,,Muse,,,,Madness,
+1500000200,,,,,,No Artist,
+`
+	songs, errs := ReadCSV(strings.NewReader(withHeader), nil)
+	if len(songs) != 2 || len(errs) != 2 {
+		t.Fatal("Expected 2 songs and 2 errors, got", songs, errs)
+	}
+	if songs[0].Title != "Uprising" || !songs[0].Timestamp.Equal(time.Unix(1500000000, 0)) {
+		t.Error("The songs weren't read oldest first:", songs)
+	}
+	if songs[0].Album != "The Resistance" || songs[0].ArtistMBID != "fd857293" {
+		t.Error("The album and MBIDs weren't read:", songs[0])
+	}
+
+	eastern := time.FixedZone("EST", -5*60*60)
+	withoutHeader := `Muse,Drones,Madness,31 Jan 2020 12:34
+Portishead,Third,Roads
+"Bjork",Debut,Joga,2020-01-31T18:00:00Z
+`
+	songs, errs = ReadCSV(strings.NewReader(withoutHeader), eastern)
+	if len(songs) != 2 || len(errs) != 1 {
+		t.Fatal("Expected 2 songs and 1 error, got", songs, errs)
+	}
+	if !songs[0].Timestamp.Equal(time.Date(2020, 1, 31, 17, 34, 0, 0, time.UTC)) {
+		t.Error("The date wasn't read in the right time zone:", songs[0].Timestamp)
+	}
+	if songs[1].Artist != "Bjork" || songs[1].Title != "Joga" {
+		t.Error("Read the wrong song:", songs[1])
+	}
+}
+
+// TestReadLastFMSongsCancelled checks that fetching stops with the
+// context's error once it's cancelled.
+func TestReadLastFMSongsCancelled(t *testing.T) {
+	if _, ok := os.LookupEnv("LASTFM_KEY"); !ok {
+		os.Setenv("LASTFM_KEY", "test")
+		defer os.Unsetenv("LASTFM_KEY")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	songs, err := ReadLastFMSongsContext(ctx, "someone")
+	if err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+	if songs != nil {
+		t.Errorf("Expected no songs, got %d", len(songs))
+	}
+}
+
+// TestReadLastFMSongsErrors checks that errors from Last.FM come back from
+// ReadLastFMSongs as the matching error.
+func TestReadLastFMSongsErrors(t *testing.T) {
+	if _, ok := os.LookupEnv("LASTFM_KEY"); !ok {
+		os.Setenv("LASTFM_KEY", "test")
+		defer os.Unsetenv("LASTFM_KEY")
+	}
+	tests := []struct {
+		status int
+		body   string
+		want   error
+	}{
+		{http.StatusForbidden, `{"error":10,"message":"Invalid API key"}`, ErrInvalidAPIKey},
+		{http.StatusNotFound, `{"error":6,"message":"User not found"}`, ErrUserNotFound},
+		{http.StatusTooManyRequests, `{"error":29,"message":"Rate limit exceeded"}`, ErrRateLimited},
+		{http.StatusOK, `{"error":16,"message":"There was a temporary error"}`, ErrServiceUnavailable},
+		{http.StatusServiceUnavailable, `<html>Service Unavailable</html>`, ErrServiceUnavailable},
+		{http.StatusOK, `{"recenttracks":`, ErrMalformedResponse},
+	}
+	defer useTestClient()()
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+		baseLastURI = server.URL + "/"
+		_, err := ReadLastFMSongs("spotkov_test_no_such_user")
+		server.Close()
+		if !errors.Is(err, test.want) {
+			t.Errorf("Expected %v for %s, got %v", test.want, test.body, err)
+		}
+	}
+
+	var apiErr *APIError
+	err := error(&APIError{Code: 6, Message: "User not found"})
+	if !errors.As(err, &apiErr) || apiErr.Message != "User not found" {
+		t.Errorf("Expected the API's message to be kept, got %v", err)
+	}
+}
+
+// useTestClient swaps in a client that doesn't wait long between retries
+// and returns a function that puts the old one back.
+func useTestClient() func() {
+	client, uri := DefaultClient, baseLastURI
+	DefaultClient = NewClient(0, 1)
+	DefaultClient.MinBackoff = time.Millisecond
+	DefaultClient.MaxBackoff = 2 * time.Millisecond
+	DefaultClient.RateLimitPause = time.Millisecond
+	return func() {
+		DefaultClient, baseLastURI = client, uri
+	}
+}
+
+// TestClientRetries checks that temporary errors are tried again
+// and that other errors aren't.
+func TestClientRetries(t *testing.T) {
+	defer useTestClient()()
+	var requests int32
+	failures := int32(3)
+	body := `{"error":29,"message":"Rate limit exceeded"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= atomic.LoadInt32(&failures) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(body))
+			return
+		}
+		w.Write([]byte(`{"recenttracks":{"track":[],"@attr":{"totalPages":"1"}}}`))
+	}))
+	defer server.Close()
+
+	if _, err := DefaultClient.getPage(context.Background(), server.URL); err != nil {
+		t.Errorf("Expected the request to succeed after retrying, got %v", err)
+	}
+	if requests != 4 {
+		t.Errorf("Expected 4 requests, got %d", requests)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&failures, 100)
+	_, err := DefaultClient.getPage(context.Background(), server.URL)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Expected %v after running out of retries, got %v", ErrRateLimited, err)
+	}
+	if int(requests) != DefaultClient.MaxRetries+1 {
+		t.Errorf("Expected %d requests, got %d", DefaultClient.MaxRetries+1, requests)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	body = `{"error":10,"message":"Invalid API key"}`
+	_, err = DefaultClient.getPage(context.Background(), server.URL)
+	if !errors.Is(err, ErrInvalidAPIKey) || requests != 1 {
+		t.Errorf("Expected %v without retrying, got %v after %d requests", ErrInvalidAPIKey, err, requests)
+	}
+}
+
+// TestRateLimiter checks that requests past the burst are spread out.
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(100, 2)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := limiter.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// two are let through straight away, then one every 10ms.
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("Expected 6 requests to take about 40ms, took %v", elapsed)
+	}
+
+	limiter.pause(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected to wait past the deadline after pausing, got %v", err)
+	}
+}
+
+// testScrobbles is a history served by newFakeLastFM, a minute apart.
+var testScrobbles = func() []Song {
+	songs := make([]Song, 1234)
+	for i := range songs {
+		songs[i] = Song{
+			Artist:    "Artist " + strconv.Itoa(i%13),
+			Title:     "Song " + strconv.Itoa(i),
+			Timestamp: time.Unix(1500000000+int64(i)*60, 0),
+		}
+	}
+	return songs
+}()
+
+// newFakeLastFM serves scrobbles like user.getrecenttracks, with a
+// song playing right now and pages taking a random amount of time.
+// Requests for failPage fail.
+func newFakeLastFM(scrobbles []Song, failPage int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		from, _ := strconv.ParseInt(query.Get("from"), 10, 64)
+		to, err := strconv.ParseInt(query.Get("to"), 10, 64)
+		if err != nil {
+			to = math.MaxInt64
+		}
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		page, _ := strconv.Atoi(query.Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		if page == failPage {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":6,"message":"User not found"}`))
+			return
+		}
+		time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+
+		tracks := make([]map[string]interface{}, 0)
+		for i := len(scrobbles) - 1; i >= 0; i-- {
+			if ts := scrobbles[i].Timestamp.Unix(); ts >= from && ts <= to {
+				song := scrobbles[i]
+				tracks = append(tracks, map[string]interface{}{
+					"artist": map[string]string{"#text": song.Artist},
+					"name":   song.Title,
+					"date":   map[string]string{"uts": strconv.FormatInt(song.Timestamp.Unix(), 10)},
+				})
+			}
+		}
+		total := len(tracks)
+		totalPages := (total + limit - 1) / limit
+		start, end := (page-1)*limit, page*limit
+		if start > len(tracks) {
+			start = len(tracks)
+		}
+		if end > len(tracks) {
+			end = len(tracks)
+		}
+		tracks = tracks[start:end]
+		if page == 1 {
+			nowPlaying := map[string]interface{}{
+				"artist": map[string]string{"#text": "Someone"},
+				"name":   "Playing Now",
+				"@attr":  map[string]string{"nowplaying": "true"},
+			}
+			tracks = append([]map[string]interface{}{nowPlaying}, tracks...)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"recenttracks": map[string]interface{}{
+				"track": tracks,
+				"@attr": map[string]string{
+					"totalPages": strconv.Itoa(totalPages),
+					"total":      strconv.Itoa(total),
+				},
+			},
+		})
+	}))
+}
+
+// TestReadLastFMSongsPages checks that pages fetched at the same time,
+// including by different calls, are put together in order.
+func TestReadLastFMSongsPages(t *testing.T) {
+	if _, ok := os.LookupEnv("LASTFM_KEY"); !ok {
+		os.Setenv("LASTFM_KEY", "test")
+		defer os.Unsetenv("LASTFM_KEY")
+	}
+	defer useTestClient()()
+	server := newFakeLastFM(testScrobbles, 0)
+	defer server.Close()
+	baseLastURI = server.URL + "/"
+
+	var wg sync.WaitGroup
+	for _, workers := range []int{1, 3, 8} {
+		wg.Add(1)
+		go func(workers int) {
+			defer wg.Done()
+			user := "spotkov_test_workers_" + strconv.Itoa(workers)
+			opts := FetchOptions{Workers: workers}
+			songs, err := ReadLastFMSongsWithOptions(context.Background(), user, opts)
+			if err != nil {
+				t.Errorf("%d workers: %v", workers, err)
+				return
+			}
+			if len(songs) != len(testScrobbles) {
+				t.Errorf("%d workers: expected %d songs, got %d", workers, len(testScrobbles), len(songs))
+				return
+			}
+			for i := range songs {
+				if songs[i] != testScrobbles[i] {
+					t.Errorf("%d workers: song %d was %v, expected %v", workers, i, songs[i], testScrobbles[i])
+					return
+				}
+			}
+		}(workers)
+	}
+	wg.Wait()
+}
+
+// TestReadLastFMSongsFailedPage checks that a page that can't be fetched
+// fails the whole read.
+func TestReadLastFMSongsFailedPage(t *testing.T) {
+	if _, ok := os.LookupEnv("LASTFM_KEY"); !ok {
+		os.Setenv("LASTFM_KEY", "test")
+		defer os.Unsetenv("LASTFM_KEY")
+	}
+	defer useTestClient()()
+	server := newFakeLastFM(testScrobbles, 4)
+	defer server.Close()
+	baseLastURI = server.URL + "/"
+
+	songs, err := ReadLastFMSongsWithOptions(context.Background(), "spotkov_test_failed_page", FetchOptions{Workers: 2})
+	if !errors.Is(err, ErrUserNotFound) || !strings.Contains(err.Error(), "page 4") {
+		t.Errorf("Expected page 4 to fail, got %v", err)
+	}
+	if songs != nil {
+		t.Errorf("Expected no songs, got %d", len(songs))
+	}
+}
+
+// TestFindAndRepairGaps checks that months with missing or extra scrobbles
+// are found and refetched, and that verified months aren't checked again.
+func TestFindAndRepairGaps(t *testing.T) {
+	if _, ok := os.LookupEnv("LASTFM_KEY"); !ok {
+		os.Setenv("LASTFM_KEY", "test")
+		defer os.Unsetenv("LASTFM_KEY")
+	}
+	defer useTestClient()()
+
+	// A song every day and a half from the start of 2017.
+	scrobbled := make([]Song, 250)
+	start := time.Date(2017, time.January, 1, 12, 0, 0, 0, time.UTC)
+	for i := range scrobbled {
+		scrobbled[i] = Song{
+			Artist:    "Artist " + strconv.Itoa(i%5),
+			Title:     "Song " + strconv.Itoa(i),
+			Timestamp: start.Add(time.Duration(i) * 36 * time.Hour),
+		}
+	}
+	server := newFakeLastFM(scrobbled, 0)
+	defer server.Close()
+	baseLastURI = server.URL + "/"
+
+	// Lose some songs in March and fetch one twice in May.
+	cached := make([]Song, 0, len(scrobbled))
+	for _, song := range scrobbled {
+		if song.Timestamp.Month() == time.March && song.Timestamp.Day() > 10 && song.Timestamp.Year() == 2017 {
+			continue
+		}
+		cached = append(cached, song)
+		if song.Title == "Song 90" {
+			cached = append(cached, song)
+		}
+	}
+
+	now := scrobbled[len(scrobbled)-1].Timestamp
+	verified := make(map[int64]int)
+	gaps, err := findGaps(context.Background(), FetchOptions{}, "someone", cached, verified, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gaps) != 2 {
+		t.Fatalf("Expected gaps in March and May, got %v", gaps)
+	}
+	if gaps[0].From.Month() != time.March || gaps[0].Missing() <= 0 {
+		t.Errorf("Expected songs to be missing in March, got %v", gaps[0])
+	}
+	if gaps[1].From.Month() != time.May || gaps[1].Missing() != -1 {
+		t.Errorf("Expected an extra song in May, got %v", gaps[1])
+	}
+	if _, ok := verified[gaps[0].From.Unix()]; ok {
+		t.Error("March shouldn't have been verified")
+	}
+	if n := verified[monthStart(start).Unix()]; n == 0 {
+		t.Error("January should have been verified")
+	}
+
+	repaired, remaining, err := repairGaps(context.Background(), FetchOptions{}, "someone", cached, gaps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 0 {
+		t.Errorf("Expected every gap to be repaired, still have %v", remaining)
+	}
+	if len(repaired) != len(scrobbled) {
+		t.Fatalf("Expected %d songs after repairing, got %d", len(scrobbled), len(repaired))
+	}
+	for i := range repaired {
+		if repaired[i].Title != scrobbled[i].Title || !repaired[i].Timestamp.Equal(scrobbled[i].Timestamp) {
+			t.Fatalf("Song %d was %v after repairing, expected %v", i, repaired[i], scrobbled[i])
+		}
+	}
+
+	// Only the current month has to be checked now that the rest match.
+	for _, gap := range gaps {
+		verified[gap.From.Unix()] = gap.Scrobbled
+	}
+	var requests int32
+	handler := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		handler.ServeHTTP(w, r)
+	})
+	gaps, err = findGaps(context.Background(), FetchOptions{}, "someone", repaired, verified, now)
+	if err != nil || len(gaps) != 0 {
+		t.Errorf("Expected no gaps after repairing, got %v, %v", gaps, err)
+	}
+	if requests != 1 {
+		t.Errorf("Expected only the current month to be checked, made %d requests", requests)
+	}
+}
+
+// TestFetchRangeResume checks that a fetch that's interrupted can be
+// carried on from its checkpoint without losing or repeating songs.
+func TestFetchRangeResume(t *testing.T) {
+	if _, ok := os.LookupEnv("LASTFM_KEY"); !ok {
+		os.Setenv("LASTFM_KEY", "test")
+		defer os.Unsetenv("LASTFM_KEY")
+	}
+	defer useTestClient()()
+	server := newFakeLastFM(testScrobbles, 0)
+	defer server.Close()
+	baseLastURI = server.URL + "/"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	songs := make([]Song, 0)
+	cp := newCheckpoint(nil, time.Now())
+	_, err := fetchRange(ctx, FetchOptions{Workers: 2}, "someone", cp, func(page []Song, progress Checkpoint) {
+		songs = append(songs, page...)
+		cp = progress
+		if cp.Done == 3 {
+			cancel()
+		}
+	})
+	if err != context.Canceled {
+		t.Fatalf("Expected the fetch to be cancelled, got %v", err)
+	}
+	// The last page only has the 34 oldest songs.
+	if cp.Done != 3 || cp.Pages != 7 || len(songs) != 34+2*pageLimit {
+		t.Fatalf("Expected 3 of 7 pages and %d songs, got %d of %d and %d songs", 34+2*pageLimit, cp.Done, cp.Pages, len(songs))
+	}
+
+	var progress []int
+	opts := FetchOptions{Workers: 2, Progress: func(done, total int) {
+		if total != cp.Pages {
+			t.Errorf("Expected %d pages in all, got %d", cp.Pages, total)
+		}
+		progress = append(progress, done)
+	}}
+	total, err := fetchRange(context.Background(), opts, "someone", cp, func(page []Song, _ Checkpoint) {
+		songs = append(songs, page...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != len(testScrobbles) || len(songs) != len(testScrobbles) {
+		t.Fatalf("Expected %d songs, got %d out of %d", len(testScrobbles), len(songs), total)
+	}
+	for i := range songs {
+		if songs[i].Title != testScrobbles[i].Title {
+			t.Fatalf("Song %d was %s, expected %s", i, songs[i].Title, testScrobbles[i].Title)
+		}
+	}
+	if len(progress) != 4 || progress[0] != 4 || progress[3] != 7 {
+		t.Errorf("Expected progress from 4 to 7 pages, got %v", progress)
+	}
+
+	// Once more scrobbles are in the range, the pages aren't the same.
+	stale := newFakeLastFM(append(testScrobbles[:len(testScrobbles):len(testScrobbles)], Song{Artist: "Late", Title: "Song", Timestamp: time.Unix(1600000000, 0)}), 0)
+	defer stale.Close()
+	baseLastURI = stale.URL + "/"
+	cp.Done = 3
+	_, err = fetchRange(context.Background(), opts, "someone", cp, func([]Song, Checkpoint) {})
+	if err != errStaleCheckpoint {
+		t.Errorf("Expected %v, got %v", errStaleCheckpoint, err)
+	}
+}
+
+// TestOldCacheMigration checks that songs cached before Song had more
+// than an artist, title and time can still be read.
+func TestOldCacheMigration(t *testing.T) {
+	type oldSong struct {
+		Artist    string
+		Title     string
+		Timestamp time.Time
+	}
+	type oldSongFile struct {
+		Songs []oldSong
+	}
+	ts := time.Unix(1500000000, 0)
+	b64, err := tools.ToBase64(oldSongFile{[]oldSong{{"Radiohead", "Reckoner", ts}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := songFile{}
+	if err = tools.FromBase64(b64, &file); err != nil {
+		t.Fatal(err)
+	}
+	want := Song{Artist: "Radiohead", Title: "Reckoner", Timestamp: ts}
+	if len(file.Songs) != 1 || file.Songs[0].Title != want.Title || !file.Songs[0].Timestamp.Equal(ts) ||
+		file.Songs[0].Album != "" || file.Songs[0].Loved {
+		t.Errorf("Expected %v, got %v", want, file.Songs)
+	}
+}
+
+// TestExtendedPage checks that albums, MBIDs and loved status are read
+// from extended track information.
+func TestExtendedPage(t *testing.T) {
+	body := `{"recenttracks":{"track":[
+		{"artist":{"name":"Radiohead","mbid":"a74b1b7f"},"name":"Reckoner","mbid":"c9e7a7a2","loved":"1",
+			"album":{"#text":"In Rainbows","mbid":"6e335887"},"date":{"uts":"1500000060"}},
+		{"artist":{"#text":"Muse","mbid":""},"name":"Madness","album":{"#text":"The 2nd Law"},
+			"date":{"uts":"1500000000"}}
+	],"@attr":{"totalPages":"1","total":"2"}}}`
+	page := SongsPage{}
+	if err := decodeResponse([]byte(body), &page); err != nil {
+		t.Fatal(err)
+	}
+	songs := pageSongs(page)
+	if len(songs) != 2 {
+		t.Fatalf("Expected 2 songs, got %v", songs)
+	}
+	madness, reckoner := songs[0], songs[1]
+	if madness.Artist != "Muse" || madness.Album != "The 2nd Law" || madness.Loved {
+		t.Errorf("Madness wasn't read right: %+v", madness)
+	}
+	if reckoner.Artist != "Radiohead" || reckoner.Album != "In Rainbows" || !reckoner.Loved ||
+		reckoner.MBID != "c9e7a7a2" || reckoner.ArtistMBID != "a74b1b7f" || reckoner.AlbumMBID != "6e335887" {
+		t.Errorf("Reckoner wasn't read right: %+v", reckoner)
+	}
+}
+
+// TestReadLovedTracks checks that every page of loved tracks is read.
+func TestReadLovedTracks(t *testing.T) {
+	if _, ok := os.LookupEnv("LASTFM_KEY"); !ok {
+		os.Setenv("LASTFM_KEY", "test")
+		defer os.Unsetenv("LASTFM_KEY")
+	}
+	useRedis := UseRedis
+	UseRedis = false
+	defer func() { UseRedis = useRedis }()
+	defer useTestClient()()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("method") != "user.getlovedtracks" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		page := r.URL.Query().Get("page")
+		w.Write([]byte(`{"lovedtracks":{"track":[{"name":"Song ` + page + `","mbid":"m` + page +
+			`","artist":{"name":"Artist","mbid":"a1"},"date":{"uts":"1500000000"}}],` +
+			`"@attr":{"page":"` + page + `","totalPages":"3"}}}`))
+	}))
+	defer server.Close()
+	baseLastURI = server.URL + "/"
+
+	songs, err := ReadLovedTracks(context.Background(), "someone", FetchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 3 {
+		t.Fatalf("Expected a song from each of 3 pages, got %v", songs)
+	}
+	for i, song := range songs {
+		if song.Title != "Song "+strconv.Itoa(i+1) || song.Artist != "Artist" || !song.Loved || song.MBID == "" {
+			t.Errorf("Song %d wasn't read right: %+v", i, song)
+		}
+	}
+}
+
+// TestReadTags checks that songs get their own tags, or their artist's if
+// they don't have any, that songs that fail are left untagged, and that
+// there aren't too many requests at once.
+func TestReadTags(t *testing.T) {
+	if _, ok := os.LookupEnv("LASTFM_KEY"); !ok {
+		os.Setenv("LASTFM_KEY", "test")
+		defer os.Unsetenv("LASTFM_KEY")
+	}
+	useRedis := UseRedis
+	UseRedis = false
+	defer func() { UseRedis = useRedis }()
+	defer useTestClient()()
+
+	var inFlight, maxInFlight int32
+	var mu sync.Mutex
+	artists := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(2 * time.Millisecond)
+
+		query := r.URL.Query()
+		if query.Get("method") == "artist.gettoptags" {
+			mu.Lock()
+			artists[query.Get("artist")]++
+			mu.Unlock()
+		}
+		switch {
+		case query.Get("track") == "Unknown":
+			w.Write([]byte(`{"error":6,"message":"Track not found"}`))
+		case query.Get("track") == "Broken":
+			w.Write([]byte(`{"error":8,"message":"Operation failed"}`))
+		case query.Get("track") == "Alison" || query.Get("track") == "Tagged":
+			w.Write([]byte(`{"toptags":{"tag":[{"name":"Dream Pop","count":40},{"name":"Shoegaze","count":100},{"name":"seen live","count":3}]}}`))
+		case query.Get("method") == "artist.gettoptags":
+			w.Write([]byte(`{"toptags":{"tag":[{"name":"` + query.Get("artist") + ` tag","count":"100"}]}}`))
+		default:
+			w.Write([]byte(`{"toptags":{"tag":[]}}`))
+		}
+	}))
+	defer server.Close()
+	baseLastURI = server.URL + "/"
+
+	songs := []BaseSong{{Artist: "Slowdive", Title: "Alison"}, {Artist: "Slowdive", Title: "Unknown"}}
+	songs = append(songs, BaseSong{Artist: "Lush", Title: "Tagged"}, BaseSong{Artist: "Ride", Title: "Broken"})
+	for i := 0; i < 20; i++ {
+		songs = append(songs, BaseSong{Artist: "Artist " + strconv.Itoa(i%4), Title: "Song " + strconv.Itoa(i)})
+	}
+	tags, err := ReadTags(context.Background(), songs, FetchOptions{Workers: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alison := tags[songs[0]]
+	if len(alison) != 2 || alison[0] != "shoegaze" || alison[1] != "dream pop" {
+		t.Errorf("Expected Alison to be tagged shoegaze and dream pop, got %v", alison)
+	}
+	if !tags.Has(songs[1], "Slowdive Tag") {
+		t.Errorf("Expected an unknown song to have its artist's tags, got %v", tags[songs[1]])
+	}
+	if !tags.Has(songs[7], "artist 3 tag") || tags.Has(songs[7], "shoegaze") {
+		t.Errorf("Song 3 has the wrong tags: %v", tags[songs[7]])
+	}
+	if _, ok := tags[songs[3]]; ok {
+		t.Errorf("Expected a song whose tags couldn't be fetched to be left untagged, got %v", tags[songs[3]])
+	}
+	if artists["Lush"] != 0 || artists["Ride"] != 0 {
+		t.Errorf("Expected artist tags only for songs without any, got %v", artists)
+	}
+	if artists["Slowdive"] != 1 || artists["Artist 3"] != 1 {
+		t.Errorf("Expected each artist's tags to be fetched once, got %v", artists)
+	}
+	if maxInFlight > 3 {
+		t.Errorf("Expected at most 3 requests at once, got %d", maxInFlight)
+	}
+}
+
+// TestSimilar checks that similar songs and artists come back most alike
+// first, and that there aren't any for ones Last.FM doesn't know.
+func TestSimilar(t *testing.T) {
+	if _, ok := os.LookupEnv("LASTFM_KEY"); !ok {
+		os.Setenv("LASTFM_KEY", "test")
+		defer os.Unsetenv("LASTFM_KEY")
+	}
+	defer useTestClient()()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch {
+		case query.Get("artist") == "Nobody":
+			w.Write([]byte(`{"error":6,"message":"The artist you supplied could not be found"}`))
+		case query.Get("method") == "track.getsimilar":
+			w.Write([]byte(`{"similartracks":{"track":[{"name":"Nude","match":0.4,"artist":{"name":"Radiohead"}},{"name":"Roads","match":0.9,"artist":{"name":"Portishead"}}]}}`))
+		case query.Get("method") == "artist.getsimilar":
+			w.Write([]byte(`{"similarartists":{"artist":[{"name":"Bjork","match":"0.2"},{"name":"Muse","match":"1"}]}}`))
+		}
+	}))
+	defer server.Close()
+	baseLastURI = server.URL + "/"
+
+	songs, err := SimilarTracks(context.Background(), BaseSong{Artist: "Slowdive", Title: "Alison"}, FetchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 2 || songs[0] != (BaseSong{Artist: "Portishead", Title: "Roads"}) || songs[1].Title != "Nude" {
+		t.Error("Expected Roads then Nude, got", songs)
+	}
+	artists, err := SimilarArtists(context.Background(), "Slowdive", FetchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artists) != 2 || artists[0] != "Muse" || artists[1] != "Bjork" {
+		t.Error("Expected Muse then Bjork, got", artists)
+	}
+	if songs, err = SimilarTracks(context.Background(), BaseSong{Artist: "Nobody"}, FetchOptions{}); err != nil || len(songs) != 0 {
+		t.Error("Expected nothing similar to an unknown song, got", songs, err)
+	}
+}
+
+// TestHistoryBetween checks that every source returns the same songs from
+// a range of time, and everything since the start when there's no end.
+func TestHistoryBetween(t *testing.T) {
+	if _, ok := os.LookupEnv("LASTFM_KEY"); !ok {
+		os.Setenv("LASTFM_KEY", "test")
+		defer os.Unsetenv("LASTFM_KEY")
+	}
+	useRedis := UseRedis
+	UseRedis = false
+	defer func() { UseRedis = useRedis }()
+	defer useTestClient()()
+	server := newFakeLastFM(testScrobbles, 0)
+	defer server.Close()
+	baseLastURI = server.URL + "/"
+
+	from, to := testScrobbles[100].Timestamp, testScrobbles[500].Timestamp
+	sources := map[string]HistorySource{
+		"Last.FM": LastFMSource{},
+		"memory":  MemorySource{"someone": testScrobbles},
+	}
+	for name, source := range sources {
+		songs, err := HistoryBetween(context.Background(), source, "someone", from, to)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if len(songs) != 400 || songs[0].Title != "Song 100" || songs[399].Title != "Song 499" {
+			t.Errorf("Expected songs 100 to 499 from %s, got %d songs", name, len(songs))
+		}
+	}
+
+	songs, err := HistoryBetween(context.Background(), sources["memory"], "someone", from, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != len(testScrobbles)-100 {
+		t.Errorf("Expected every song from 100 on, got %d", len(songs))
+	}
+}
+
+// useMemoryCache keeps the cache in store instead of Redis, and returns a
+// function to put things back.
+func useMemoryCache(store map[string]string) func() {
+	get, set, useRedis := cacheGet, cacheSet, UseRedis
+	cacheGet = func(key string) (string, error) {
+		if v, ok := store[key]; ok {
+			return v, nil
+		}
+		return "", redis.Nil
+	}
+	cacheSet = func(key, value string) error {
+		store[key] = value
+		return nil
+	}
+	UseRedis = true
+	return func() {
+		cacheGet, cacheSet, UseRedis = get, set, useRedis
+	}
+}
+
+// TestImportSongsUnreadableCache checks that an import doesn't overwrite a
+// cache that couldn't be read, but does fill in one that's missing.
+func TestImportSongsUnreadableCache(t *testing.T) {
+	store := map[string]string{allSongCachePrefix + "someone": "not a cache"}
+	defer useMemoryCache(store)()
+
+	songs := []Song{{Artist: "Muse", Title: "Madness", Timestamp: time.Unix(1500000000, 0)}}
+	if _, err := ImportSongs("someone", songs); err == nil {
+		t.Error("Expected an error when the cache couldn't be read")
+	}
+	if len(store) != 1 || store[allSongCachePrefix+"someone"] != "not a cache" {
+		t.Error("The cache was changed even though it couldn't be read:", store)
+	}
+
+	added, err := ImportSongs("someone else", songs)
+	if err != nil || added != 1 {
+		t.Fatal("Expected 1 song to be imported into an empty cache, got", added, err)
+	}
+	file := songFile{}
+	if err = readCachedSongs("someone else", &file); err != nil || len(file.Songs) != 1 {
+		t.Error("Expected the imported song to be cached, got", file.Songs, err)
+	}
+	var uniques SongMap
+	if err = ReadCachedUniqueSongs("nobody", &uniques); !errors.Is(err, ErrNotCached) {
+		t.Error("Expected", ErrNotCached, "for a user without a cache, got", err)
+	}
+}
@@ -0,0 +1,86 @@
+package lastFm
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// lovedCachePrefix is the Redis key prefix for a user's loved tracks.
+const lovedCachePrefix = "lovedCache."
+
+// lovedCacheAge is how long cached loved tracks are used before they're
+// fetched again. Loving a song doesn't make a new scrobble, so the cache
+// can't be brought up to date like scrobbles are.
+const lovedCacheAge = 24 * time.Hour
+
+// lovedPage holds a page of a user's loved tracks.
+type lovedPage struct {
+	LovedTracks tracksWrapper `json:"lovedtracks"`
+}
+
+// lovedFile holds a user's loved tracks and when they were fetched.
+type lovedFile struct {
+	Songs   []Song
+	Fetched time.Time
+}
+
+// ReadLovedTracks returns the songs the user has loved on Last.FM, with
+// when each one was loved as the timestamp, newest first. They're cached
+// for a day.
+func ReadLovedTracks(ctx context.Context, userID string, opts FetchOptions) ([]Song, error) {
+	file := lovedFile{}
+	err := ReadCache(userID, lovedCachePrefix, &file)
+	if err == nil && time.Since(file.Fetched) < lovedCacheAge {
+		return file.Songs, nil
+	}
+
+	songs, err := fetchLovedTracks(ctx, opts, userID)
+	if err != nil {
+		return nil, err
+	}
+	err = WriteCache(userID, lovedCachePrefix, lovedFile{Songs: songs, Fetched: time.Now()})
+	if err != nil && UseRedis {
+		fmt.Println("Couldn't cache loved tracks:", err.Error())
+	}
+	return songs, nil
+}
+
+// fetchLovedTracks fetches every page of the user's loved tracks.
+func fetchLovedTracks(ctx context.Context, opts FetchOptions, userID string) ([]Song, error) {
+	songs := make([]Song, 0)
+	for page, pages := 1, 1; page <= pages; page++ {
+		query := url.Values{}
+		query.Set("user", userID)
+		query.Set("limit", strconv.Itoa(pageLimit))
+		query.Set("page", strconv.Itoa(page))
+		last_url, err := apiURL("user.getlovedtracks", query)
+		if err != nil {
+			return nil, err
+		}
+		loved := lovedPage{}
+		if err = opts.client().get(ctx, last_url, &loved); err != nil {
+			return nil, err
+		}
+		pages, _ = strconv.Atoi(loved.LovedTracks.Metadata.TotalPages)
+
+		for _, track := range loved.LovedTracks.Tracks {
+			utime, err := strconv.ParseInt(track.Timestamp.UnixTime, 10, 64)
+			var ts time.Time
+			if err == nil {
+				ts = time.Unix(utime, 0)
+			}
+			songs = append(songs, Song{
+				Artist:     track.Artist.name(),
+				Title:      track.Title,
+				Timestamp:  ts,
+				MBID:       track.MBID,
+				ArtistMBID: track.Artist.MBID,
+				Loved:      true,
+			})
+		}
+	}
+	return songs, nil
+}
@@ -0,0 +1,113 @@
+package lastFm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// similarLimit is how many similar songs or artists are asked for.
+const similarLimit = 100
+
+// similarTracks holds the response from track.getSimilar.
+type similarTracks struct {
+	SimilarTracks struct {
+		Tracks []struct {
+			Name   string     `json:"name"`
+			Match  matchValue `json:"match"`
+			Artist artist     `json:"artist"`
+		} `json:"track"`
+	} `json:"similartracks"`
+}
+
+// similarArtists holds the response from artist.getSimilar.
+type similarArtists struct {
+	SimilarArtists struct {
+		Artists []struct {
+			Name  string     `json:"name"`
+			Match matchValue `json:"match"`
+		} `json:"artist"`
+	} `json:"similarartists"`
+}
+
+// matchValue is how similar something is, from 0 to 1. Last.FM sends it
+// as a number or a string depending on the method.
+type matchValue float64
+
+func (m *matchValue) UnmarshalJSON(b []byte) error {
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		var s string
+		if err = json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		n = json.Number(s)
+	}
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return err
+	}
+	*m = matchValue(f)
+	return nil
+}
+
+// SimilarTracks returns the songs Last.FM says are most like song, most
+// similar first. Songs Last.FM doesn't know have none.
+func SimilarTracks(ctx context.Context, song BaseSong, opts FetchOptions) ([]BaseSong, error) {
+	query := url.Values{}
+	query.Set("artist", song.Artist)
+	query.Set("track", song.Title)
+	query.Set("autocorrect", "1")
+	query.Set("limit", strconv.Itoa(similarLimit))
+	similar := similarTracks{}
+	if err := getSimilar(ctx, opts, "track.getsimilar", query, &similar); err != nil {
+		return nil, err
+	}
+
+	tracks := similar.SimilarTracks.Tracks
+	sort.SliceStable(tracks, func(i, j int) bool { return tracks[i].Match > tracks[j].Match })
+	songs := make([]BaseSong, 0, len(tracks))
+	for _, track := range tracks {
+		songs = append(songs, BaseSong{Artist: track.Artist.name(), Title: track.Name})
+	}
+	return songs, nil
+}
+
+// SimilarArtists returns the artists Last.FM says are most like artist,
+// most similar first. Artists Last.FM doesn't know have none.
+func SimilarArtists(ctx context.Context, artist string, opts FetchOptions) ([]string, error) {
+	query := url.Values{}
+	query.Set("artist", artist)
+	query.Set("autocorrect", "1")
+	query.Set("limit", strconv.Itoa(similarLimit))
+	similar := similarArtists{}
+	if err := getSimilar(ctx, opts, "artist.getsimilar", query, &similar); err != nil {
+		return nil, err
+	}
+
+	found := similar.SimilarArtists.Artists
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Match > found[j].Match })
+	artists := make([]string, 0, len(found))
+	for _, a := range found {
+		artists = append(artists, a.Name)
+	}
+	return artists, nil
+}
+
+// getSimilar calls one of the similarity methods, treating songs and
+// artists that Last.FM doesn't know as having nothing similar.
+func getSimilar(ctx context.Context, opts FetchOptions, method string, query url.Values, v interface{}) error {
+	last_url, err := apiURL(method, query)
+	if err != nil {
+		return err
+	}
+	err = opts.client().get(ctx, last_url, v)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Code == codeInvalidParameters {
+		return nil
+	}
+	return err
+}
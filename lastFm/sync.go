@@ -0,0 +1,215 @@
+package lastFm
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// syncCachePrefix is the Redis key prefix for a user's SyncRecord.
+const syncCachePrefix = "syncCache."
+
+// Gap is a month where the cache doesn't have the same number of
+// scrobbles as Last.FM, because pages were lost or fetched twice.
+type Gap struct {
+	From, To  time.Time
+	Cached    int
+	Scrobbled int
+}
+
+// Missing is how many scrobbles the cache is missing in the gap.
+// It's negative if the cache has extra ones.
+func (g Gap) Missing() int {
+	return g.Scrobbled - g.Cached
+}
+
+// SyncRecord holds how many scrobbles were cached in each month that
+// matched Last.FM when it was last checked, keyed by the Unix time of the
+// start of the month. Months that still have that many don't need to be
+// checked again.
+type SyncRecord struct {
+	Verified map[int64]int
+}
+
+// readSyncRecord reads the user's SyncRecord, or returns an empty one.
+func readSyncRecord(userID string) SyncRecord {
+	record := SyncRecord{}
+	ReadCache(userID, syncCachePrefix, &record)
+	if record.Verified == nil {
+		record.Verified = make(map[int64]int)
+	}
+	return record
+}
+
+// VerifyHistory compares the user's cached scrobbles with Last.FM one month
+// at a time and returns the months where they don't match, oldest first.
+func VerifyHistory(ctx context.Context, userID string, opts FetchOptions) ([]Gap, error) {
+	file := songFile{}
+	if err := readCachedSongs(userID, &file); err != nil || len(file.Songs) == 0 {
+		return nil, errors.New("Nothing is cached for " + userID + " yet, so there's nothing to verify.")
+	}
+	sortByTimestamp(file.Songs)
+	record := readSyncRecord(userID)
+	gaps, err := findGaps(ctx, opts, userID, file.Songs, record.Verified, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	WriteCache(userID, syncCachePrefix, record)
+	return gaps, nil
+}
+
+// RepairHistory refetches the scrobbles in each gap and replaces the ones
+// in the cache with them. It returns the gaps that still don't match,
+// which can happen if the user scrobbled or deleted songs in the meantime.
+func RepairHistory(ctx context.Context, userID string, gaps []Gap, opts FetchOptions) ([]Gap, error) {
+	file := songFile{}
+	if err := readCachedSongs(userID, &file); err != nil {
+		return nil, err
+	}
+	var uniques SongMap
+	if err := ReadCachedUniqueSongs(userID, &uniques); err != nil {
+		uniques.Songs = make(map[BaseSong]bool)
+	}
+	sortByTimestamp(file.Songs)
+	songs, remaining, err := repairGaps(ctx, opts, userID, file.Songs, gaps)
+	if err != nil {
+		return nil, err
+	}
+	for _, song := range songs {
+		uniques.Songs[BaseSong{Artist: song.Artist, Title: song.Title}] = true
+	}
+	if err = cacheSongs(userID, songFile{songs}); err != nil {
+		return nil, err
+	}
+	if err = cacheUniqueSongs(userID, uniques); err != nil {
+		return nil, err
+	}
+
+	record := readSyncRecord(userID)
+	for _, gap := range gaps {
+		delete(record.Verified, gap.From.Unix())
+	}
+	for _, gap := range gaps {
+		if !isGap(remaining, gap) {
+			record.Verified[gap.From.Unix()] = gap.Scrobbled
+		}
+	}
+	WriteCache(userID, syncCachePrefix, record)
+	return remaining, nil
+}
+
+// isGap reports whether gap's month is in gaps.
+func isGap(gaps []Gap, gap Gap) bool {
+	for _, g := range gaps {
+		if g.From.Equal(gap.From) {
+			return true
+		}
+	}
+	return false
+}
+
+// monthStart returns the start of t's month in UTC.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// findGaps counts songs, which are oldest first, in each month up to now
+// and compares the counts with Last.FM's. Months in verified that still
+// have the same count aren't checked, and months that match are added to
+// verified.
+func findGaps(ctx context.Context, opts FetchOptions, userID string, songs []Song, verified map[int64]int, now time.Time) ([]Gap, error) {
+	counts := make(map[int64]int)
+	var first time.Time
+	for _, song := range songs {
+		if song.Timestamp.IsZero() {
+			continue
+		}
+		if first.IsZero() {
+			first = song.Timestamp
+		}
+		counts[monthStart(song.Timestamp).Unix()]++
+	}
+	if first.IsZero() {
+		return nil, nil
+	}
+
+	current := monthStart(now)
+	gaps := make([]Gap, 0)
+	for month := monthStart(first); !month.After(current); month = month.AddDate(0, 1, 0) {
+		key := month.Unix()
+		cached := counts[key]
+		if n, ok := verified[key]; ok && n == cached && month.Before(current) {
+			continue
+		}
+		to := month.AddDate(0, 1, 0).Add(-time.Second)
+		scrobbled, err := countScrobbles(ctx, opts, userID, month, to)
+		if err != nil {
+			return nil, err
+		}
+		if scrobbled != cached {
+			gaps = append(gaps, Gap{From: month, To: to, Cached: cached, Scrobbled: scrobbled})
+			delete(verified, key)
+		} else {
+			verified[key] = cached
+		}
+	}
+	return gaps, nil
+}
+
+// countScrobbles asks Last.FM how many scrobbles the user has from from
+// until to, inclusive.
+func countScrobbles(ctx context.Context, opts FetchOptions, userID string, from, to time.Time) (int, error) {
+	last_url, err := recentTracksURL(userID, from, to, 1)
+	if err != nil {
+		return 0, err
+	}
+	page, err := opts.client().getPage(ctx, last_url)
+	if err != nil {
+		return 0, err
+	}
+	total, err := strconv.Atoi(page.RecentTracks.Metadata.TotalSongs)
+	if err != nil {
+		return 0, ErrMalformedResponse
+	}
+	return total, nil
+}
+
+// repairGaps refetches the scrobbles in each gap and puts them in place
+// of the ones in songs, returning the repaired songs oldest first and the
+// gaps that still don't have the right number of scrobbles.
+func repairGaps(ctx context.Context, opts FetchOptions, userID string, songs []Song, gaps []Gap) ([]Song, []Gap, error) {
+	inGap := func(song Song) bool {
+		for _, gap := range gaps {
+			if !song.Timestamp.Before(gap.From) && !song.Timestamp.After(gap.To) {
+				return true
+			}
+		}
+		return false
+	}
+	repaired := make([]Song, 0, len(songs))
+	for _, song := range songs {
+		if !inGap(song) {
+			repaired = append(repaired, song)
+		}
+	}
+
+	remaining := make([]Gap, 0)
+	for _, gap := range gaps {
+		fetched := 0
+		cp := Checkpoint{From: gap.From, To: gap.To}
+		total, err := fetchRange(ctx, opts, userID, cp, func(page []Song, cp Checkpoint) {
+			repaired = append(repaired, page...)
+			fetched += len(page)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if fetched != total {
+			remaining = append(remaining, Gap{From: gap.From, To: gap.To, Cached: fetched, Scrobbled: total})
+		}
+	}
+	sortByTimestamp(repaired)
+	return repaired, remaining, nil
+}
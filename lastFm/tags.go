@@ -0,0 +1,266 @@
+package lastFm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Redis key prefixes for cached tags. Tags don't depend on the user, so
+// they're cached by song and artist instead.
+const trackTagCachePrefix = "trackTagCache."
+const artistTagCachePrefix = "artistTagCache."
+
+// tagCacheAge is how long cached tags are used before they're fetched
+// again. Tags change slowly, so this is long.
+const tagCacheAge = 30 * 24 * time.Hour
+
+// Only tags used at least minTagCount times, relative to the most used
+// tag's 100, are kept, and at most maxTags of them.
+const minTagCount = 10
+const maxTags = 10
+
+// Tags holds the tags of songs, lower case and most used first.
+type Tags map[BaseSong][]string
+
+// Has reports whether the song has any of the tags. Tags are compared
+// without regard to case.
+func (t Tags) Has(song BaseSong, tags ...string) bool {
+	for _, have := range t[song] {
+		for _, tag := range tags {
+			if strings.EqualFold(have, tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// topTags holds the response from track.getTopTags or artist.getTopTags.
+type topTags struct {
+	TopTags struct {
+		Tags []struct {
+			Name  string   `json:"name"`
+			Count tagCount `json:"count"`
+		} `json:"tag"`
+	} `json:"toptags"`
+}
+
+// tagCount is how often a tag is used. Last.FM sends it as a number or a
+// string depending on the method.
+type tagCount int
+
+func (c *tagCount) UnmarshalJSON(b []byte) error {
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		var s string
+		if err = json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		n = json.Number(s)
+	}
+	i, err := strconv.Atoi(string(n))
+	if err != nil {
+		return err
+	}
+	*c = tagCount(i)
+	return nil
+}
+
+// tagFile holds cached tags and when they were fetched.
+type tagFile struct {
+	Tags    []string
+	Fetched time.Time
+}
+
+// ReadTags returns the tags of each song. A song's own tags are used if it
+// has any, and otherwise its artist's, which are only looked up for artists
+// with songs that have none. Tags are cached for a month, and no more than
+// opts.Workers songs are looked up at once. opts.Progress is called with
+// how many lookups are done.
+//
+// Songs whose tags couldn't be fetched are left untagged, with a message
+// saying why. An error is only returned if the context is cancelled or
+// Last.FM won't take the API key, since then nothing can be fetched.
+func ReadTags(ctx context.Context, songs []BaseSong, opts FetchOptions) (Tags, error) {
+	total := int32(len(songs))
+	var done int32
+	progress := func() {
+		n := atomic.AddInt32(&done, 1)
+		if opts.Progress != nil {
+			opts.Progress(int(n), int(atomic.LoadInt32(&total)))
+		}
+	}
+
+	songTags := make([][]string, len(songs))
+	failed := make([]bool, len(songs))
+	err := forEach(ctx, opts.workers(), len(songs), func(i int) error {
+		defer progress()
+		tags, err := readTags(ctx, opts, trackTagCachePrefix, songs[i].Artist, songs[i].Title)
+		if err != nil {
+			if isFatalTagError(err) {
+				return err
+			}
+			fmt.Println("Couldn't get the tags of", songs[i].Title, "by", songs[i].Artist+":", err)
+			failed[i] = true
+		}
+		songTags[i] = tags
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Only artists with songs that don't have any tags are needed.
+	artists := make([]string, 0)
+	seen := make(map[string]bool)
+	for i, song := range songs {
+		if len(songTags[i]) == 0 && !failed[i] && !seen[song.Artist] {
+			seen[song.Artist] = true
+			artists = append(artists, song.Artist)
+		}
+	}
+	atomic.AddInt32(&total, int32(len(artists)))
+	artistTags := make([][]string, len(artists))
+	err = forEach(ctx, opts.workers(), len(artists), func(i int) error {
+		defer progress()
+		tags, err := readTags(ctx, opts, artistTagCachePrefix, artists[i], "")
+		if err != nil {
+			if isFatalTagError(err) {
+				return err
+			}
+			fmt.Println("Couldn't get the tags of", artists[i]+":", err)
+		}
+		artistTags[i] = tags
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	byArtist := make(map[string][]string, len(artists))
+	for i, artist := range artists {
+		byArtist[artist] = artistTags[i]
+	}
+
+	tags := make(Tags, len(songs))
+	for i, song := range songs {
+		if len(songTags[i]) > 0 {
+			tags[song] = songTags[i]
+		} else if !failed[i] && len(byArtist[song.Artist]) > 0 {
+			tags[song] = byArtist[song.Artist]
+		}
+	}
+	return tags, nil
+}
+
+// isFatalTagError reports whether err means no more tags can be fetched,
+// rather than just the ones being looked up.
+func isFatalTagError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrInvalidAPIKey) || errors.Is(err, ErrMissingAPIKey)
+}
+
+// readTags returns the tags of a song, or of an artist if title is empty,
+// from the cache if they're there and otherwise from Last.FM.
+func readTags(ctx context.Context, opts FetchOptions, prefix, artist, title string) ([]string, error) {
+	key := strings.ToLower(artist)
+	if title != "" {
+		key += "\x00" + strings.ToLower(title)
+	}
+	file := tagFile{}
+	if err := ReadCache(key, prefix, &file); err == nil && time.Since(file.Fetched) < tagCacheAge {
+		return file.Tags, nil
+	}
+
+	tags, err := fetchTags(ctx, opts, artist, title)
+	if err != nil {
+		return nil, err
+	}
+	if err = WriteCache(key, prefix, tagFile{Tags: tags, Fetched: time.Now()}); err != nil && UseRedis {
+		fmt.Println("Couldn't cache tags:", err.Error())
+	}
+	return tags, nil
+}
+
+// fetchTags fetches the top tags of a song, or of an artist if title is
+// empty. Songs and artists Last.FM doesn't know have no tags.
+func fetchTags(ctx context.Context, opts FetchOptions, artist, title string) ([]string, error) {
+	query := url.Values{}
+	query.Set("artist", artist)
+	query.Set("autocorrect", "1")
+	method := "artist.gettoptags"
+	if title != "" {
+		query.Set("track", title)
+		method = "track.gettoptags"
+	}
+	last_url, err := apiURL(method, query)
+	if err != nil {
+		return nil, err
+	}
+	top := topTags{}
+	err = opts.client().get(ctx, last_url, &top)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Code == codeInvalidParameters {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	found := top.TopTags.Tags
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Count > found[j].Count })
+	tags := make([]string, 0, maxTags)
+	for _, tag := range found {
+		if len(tags) == maxTags || tag.Count < minTagCount {
+			break
+		}
+		tags = append(tags, strings.ToLower(strings.TrimSpace(tag.Name)))
+	}
+	return tags, nil
+}
+
+// forEach calls f for 0 through n-1 with no more than workers calls at
+// once, and returns the first error.
+func forEach(ctx context.Context, workers, n int, f func(i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan int)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := f(i); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+	if err, ok := <-errs; ok {
+		return err
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,312 @@
+// Package listenBrainz retrieves listening history from ListenBrainz,
+// as an alternative to Last.FM.
+package listenBrainz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/snyderks/spotkov/lastFm"
+)
+
+// BaseURL is the root of the ListenBrainz API.
+const BaseURL = "https://api.listenbrainz.org/1/"
+
+// listensPerPage is how many listens are asked for at once.
+// This is the most the API allows.
+const listensPerPage = 1000
+
+// cachePrefix is the Redis key prefix for a user's cached listens.
+const cachePrefix = "listenBrainzCache."
+
+// listensPage is a page of listens as returned by the API.
+type listensPage struct {
+	Payload struct {
+		Count   int      `json:"count"`
+		Listens []listen `json:"listens"`
+	} `json:"payload"`
+}
+
+// listen is one song listened to.
+type listen struct {
+	ListenedAt    int64 `json:"listened_at"`
+	TrackMetadata struct {
+		ArtistName     string `json:"artist_name"`
+		TrackName      string `json:"track_name"`
+		ReleaseName    string `json:"release_name"`
+		AdditionalInfo struct {
+			RecordingMBID string   `json:"recording_mbid"`
+			ReleaseMBID   string   `json:"release_mbid"`
+			ArtistMBIDs   []string `json:"artist_mbids"`
+		} `json:"additional_info"`
+	} `json:"track_metadata"`
+}
+
+// song turns the listen into a song.
+func (l listen) song() lastFm.Song {
+	info := l.TrackMetadata.AdditionalInfo
+	song := lastFm.Song{
+		Artist:    l.TrackMetadata.ArtistName,
+		Title:     l.TrackMetadata.TrackName,
+		Timestamp: time.Unix(l.ListenedAt, 0),
+		Album:     l.TrackMetadata.ReleaseName,
+		MBID:      info.RecordingMBID,
+		AlbumMBID: info.ReleaseMBID,
+	}
+	if len(info.ArtistMBIDs) > 0 {
+		song.ArtistMBID = info.ArtistMBIDs[0]
+	}
+	return song
+}
+
+// apiError is the format of an error returned by the API.
+type apiError struct {
+	Code  int    `json:"code"`
+	Error string `json:"error"`
+}
+
+// Client makes requests to the ListenBrainz API.
+type Client struct {
+	// BaseURL is the root of the API, which is BaseURL unless testing.
+	BaseURL string
+	// Token is a user token. It's optional, but raises the rate limit.
+	Token string
+	HTTP  *http.Client
+}
+
+// NewClient returns a client for the ListenBrainz API.
+// The token can be left empty.
+func NewClient(token string) *Client {
+	return &Client{
+		BaseURL: BaseURL,
+		Token:   token,
+		HTTP:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Listens returns every song the user listened to from since on, oldest
+// first. That includes listens in the same second as since, which may
+// already have been seen. If since is zero, the user's whole history is
+// returned.
+func (c *Client) Listens(ctx context.Context, user string, since time.Time) ([]lastFm.Song, error) {
+	if since.IsZero() {
+		return c.listensBackwards(ctx, user)
+	}
+	return c.listensForwards(ctx, user, since)
+}
+
+// listenKey tells listens apart, since ListenBrainz only keeps one listen
+// of a track in each second.
+type listenKey struct {
+	ListenedAt int64
+	Artist     string
+	Track      string
+}
+
+// key returns the key for the listen.
+func (l listen) key() listenKey {
+	return listenKey{l.ListenedAt, l.TrackMetadata.ArtistName, l.TrackMetadata.TrackName}
+}
+
+// listensBackwards pages through the user's whole history with max_ts,
+// newest first.
+//
+// max_ts leaves out listens at that time, and there may be listens in the
+// same second as the oldest one on a page that didn't fit on it. So each
+// page after the first ends a second after the one before it, and listens
+// that were already seen are dropped.
+func (c *Client) listensBackwards(ctx context.Context, user string) ([]lastFm.Song, error) {
+	seen := make(map[listenKey]bool)
+	newestFirst := make([]lastFm.Song, 0)
+	var maxTs int64
+	for {
+		query := url.Values{}
+		if maxTs > 0 {
+			query.Set("max_ts", strconv.FormatInt(maxTs, 10))
+		}
+		page, err := c.getListens(ctx, user, query)
+		if err != nil {
+			return nil, err
+		}
+		listens := page.Payload.Listens
+		var oldest int64
+		added := 0
+		for _, l := range listens {
+			if oldest == 0 || l.ListenedAt < oldest {
+				oldest = l.ListenedAt
+			}
+			if !seen[l.key()] {
+				seen[l.key()] = true
+				newestFirst = append(newestFirst, l.song())
+				added++
+			}
+		}
+		if len(listens) < listensPerPage {
+			break
+		}
+		maxTs = oldest + 1
+		if added == 0 {
+			// The whole page was in one second, so move past it.
+			maxTs = oldest
+		}
+	}
+
+	history := make([]lastFm.Song, 0, len(newestFirst))
+	for i := len(newestFirst) - 1; i >= 0; i-- {
+		history = append(history, newestFirst[i])
+	}
+	return history, nil
+}
+
+// listensForwards pages through the user's listens from since on with
+// min_ts, oldest first. Like listensBackwards, each page starts a second
+// before the newest listen on the page before it, and listens that were
+// already seen are dropped.
+func (c *Client) listensForwards(ctx context.Context, user string, since time.Time) ([]lastFm.Song, error) {
+	seen := make(map[listenKey]bool)
+	history := make([]lastFm.Song, 0)
+	// min_ts leaves out listens at that time.
+	minTs := since.Unix() - 1
+	for {
+		query := url.Values{}
+		query.Set("min_ts", strconv.FormatInt(minTs, 10))
+		page, err := c.getListens(ctx, user, query)
+		if err != nil {
+			return nil, err
+		}
+		listens := page.Payload.Listens
+		var newest int64
+		added := 0
+		// Pages are newest first.
+		for i := len(listens) - 1; i >= 0; i-- {
+			l := listens[i]
+			if l.ListenedAt > newest {
+				newest = l.ListenedAt
+			}
+			if !seen[l.key()] {
+				seen[l.key()] = true
+				history = append(history, l.song())
+				added++
+			}
+		}
+		if len(listens) < listensPerPage {
+			break
+		}
+		minTs = newest - 1
+		if added == 0 {
+			minTs = newest
+		}
+	}
+	return history, nil
+}
+
+// getListens requests a page of the user's listens. query says which
+// ones, with max_ts or min_ts, or it can be empty for the most recent.
+func (c *Client) getListens(ctx context.Context, user string, query url.Values) (listensPage, error) {
+	query.Set("count", strconv.Itoa(listensPerPage))
+	u := c.BaseURL + "user/" + url.PathEscape(user) + "/listens?" + query.Encode()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return listensPage{}, err
+	}
+	req = req.WithContext(ctx)
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Token "+c.Token)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return listensPage{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := apiError{}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		if apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		return listensPage{}, fmt.Errorf("ListenBrainz returned an error for %s: %s", user, apiErr.Error)
+	}
+	page := listensPage{}
+	if err = json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return listensPage{}, errors.New("Couldn't read the response from ListenBrainz: " + err.Error())
+	}
+	return page, nil
+}
+
+// listenFile contains a user's cached listens.
+type listenFile struct {
+	Songs []lastFm.Song
+}
+
+// Source is a lastFm.HistorySource that reads a user's listens from
+// ListenBrainz. Listens are kept in the cache when it's available, so only
+// new listens are fetched after the first time.
+type Source struct {
+	Client *Client
+	// User is the ListenBrainz user to read. If it's empty, the user ID
+	// passed to History is used instead.
+	User string
+}
+
+// History returns the user's listens, oldest first.
+func (s Source) History(ctx context.Context, userID string) ([]lastFm.Song, error) {
+	if s.User != "" {
+		userID = s.User
+	}
+	file := listenFile{}
+	// a missing cache just means everything has to be fetched.
+	lastFm.ReadCache(userID, cachePrefix, &file)
+
+	var since time.Time
+	if len(file.Songs) > 0 {
+		since = file.Songs[len(file.Songs)-1].Timestamp
+	}
+	songs, err := s.Client.Listens(ctx, userID, since)
+	if err != nil {
+		return nil, err
+	}
+	songs = newListens(file.Songs, songs)
+	file.Songs = append(file.Songs, songs...)
+	if len(songs) > 0 {
+		if err = lastFm.WriteCache(userID, cachePrefix, file); err != nil && lastFm.UseRedis {
+			fmt.Println("Couldn't cache the listens:", err.Error())
+		}
+	}
+	if len(file.Songs) == 0 {
+		return nil, errors.New("No listens were found for " + userID + " on ListenBrainz.")
+	}
+	return file.Songs, nil
+}
+
+// newListens returns the songs that aren't already in cached. songs start
+// in the same second as the last cached song, so only the cached songs
+// from then on are checked.
+func newListens(cached []lastFm.Song, songs []lastFm.Song) []lastFm.Song {
+	if len(cached) == 0 {
+		return songs
+	}
+	type played struct {
+		lastFm.BaseSong
+		unix int64
+	}
+	since := cached[len(cached)-1].Timestamp.Unix()
+	seen := make(map[played]bool)
+	for i := len(cached) - 1; i >= 0 && cached[i].Timestamp.Unix() >= since; i-- {
+		seen[played{lastFm.BaseSong{Artist: cached[i].Artist, Title: cached[i].Title}, since}] = true
+	}
+	fresh := make([]lastFm.Song, 0, len(songs))
+	for _, song := range songs {
+		if !seen[played{lastFm.BaseSong{Artist: song.Artist, Title: song.Title}, song.Timestamp.Unix()}] {
+			fresh = append(fresh, song)
+		}
+	}
+	return fresh
+}
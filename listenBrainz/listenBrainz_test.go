@@ -0,0 +1,215 @@
+package listenBrainz
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/snyderks/spotkov/lastFm"
+)
+
+// testListens stands in for a user's listens on ListenBrainz.
+// Listens are ten seconds apart, so there are more than fit on one page.
+var testListens = func() []listen {
+	listens := make([]listen, 2500)
+	for i := range listens {
+		listens[i].ListenedAt = 1500000000 + int64(i)*10
+		listens[i].TrackMetadata.ArtistName = "Artist " + strconv.Itoa(i%7)
+		listens[i].TrackMetadata.TrackName = "Song " + strconv.Itoa(i)
+	}
+	return listens
+}()
+
+// newTestServer serves testListens the way ListenBrainz does: before
+// max_ts, or the oldest ones after min_ts, newest first either way.
+// Each query is recorded in queries if it isn't nil.
+func newTestServer(listens []listen, queries *[]url.Values) *httptest.Server {
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/user/someone/listens" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(apiError{Code: 404, Error: "Cannot find user: " + strings.TrimPrefix(r.URL.Path, "/user/")})
+			return
+		}
+		query := r.URL.Query()
+		if queries != nil {
+			mu.Lock()
+			*queries = append(*queries, query)
+			mu.Unlock()
+		}
+		count, _ := strconv.Atoi(query.Get("count"))
+		maxTs, _ := strconv.ParseInt(query.Get("max_ts"), 10, 64)
+		minTs, err := strconv.ParseInt(query.Get("min_ts"), 10, 64)
+		forwards := err == nil
+
+		sorted := make([]listen, len(listens))
+		copy(sorted, listens)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			if forwards {
+				return sorted[i].ListenedAt < sorted[j].ListenedAt
+			}
+			return sorted[i].ListenedAt > sorted[j].ListenedAt
+		})
+		page := listensPage{}
+		for _, l := range sorted {
+			if len(page.Payload.Listens) == count {
+				break
+			}
+			if forwards && l.ListenedAt > minTs || !forwards && (maxTs == 0 || l.ListenedAt < maxTs) {
+				page.Payload.Listens = append(page.Payload.Listens, l)
+			}
+		}
+		if forwards {
+			for i, j := 0, len(page.Payload.Listens)-1; i < j; i, j = i+1, j-1 {
+				page.Payload.Listens[i], page.Payload.Listens[j] = page.Payload.Listens[j], page.Payload.Listens[i]
+			}
+		}
+		page.Payload.Count = len(page.Payload.Listens)
+		json.NewEncoder(w).Encode(page)
+	}))
+}
+
+func newTestClient(url string) *Client {
+	c := NewClient("")
+	c.BaseURL = url + "/"
+	return c
+}
+
+// TestListens checks that a whole history is read across pages, oldest first.
+func TestListens(t *testing.T) {
+	server := newTestServer(testListens, nil)
+	defer server.Close()
+
+	songs, err := newTestClient(server.URL).Listens(context.Background(), "someone", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != len(testListens) {
+		t.Fatalf("Expected %d songs, got %d", len(testListens), len(songs))
+	}
+	for i, song := range songs {
+		l := testListens[i]
+		if song.Title != l.TrackMetadata.TrackName || song.Artist != l.TrackMetadata.ArtistName {
+			t.Fatalf("Song %d was %s by %s, expected %s by %s", i, song.Title, song.Artist,
+				l.TrackMetadata.TrackName, l.TrackMetadata.ArtistName)
+		}
+		if song.Timestamp.Unix() != l.ListenedAt {
+			t.Fatalf("Song %d was listened to at %d, expected %d", i, song.Timestamp.Unix(), l.ListenedAt)
+		}
+	}
+}
+
+// TestListensSince checks that only listens from since on are read, using
+// min_ts, and that the ones already cached are dropped.
+func TestListensSince(t *testing.T) {
+	var queries []url.Values
+	server := newTestServer(testListens, &queries)
+	defer server.Close()
+
+	since := time.Unix(testListens[2200].ListenedAt, 0)
+	songs, err := newTestClient(server.URL).Listens(context.Background(), "someone", since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 300 {
+		t.Fatalf("Expected 300 songs from %v, got %d", since, len(songs))
+	}
+	if songs[0].Title != "Song 2200" || songs[len(songs)-1].Title != "Song 2499" {
+		t.Errorf("Expected Song 2200 to Song 2499, got %s to %s", songs[0].Title, songs[len(songs)-1].Title)
+	}
+	for _, query := range queries {
+		if query.Get("min_ts") == "" || query.Get("max_ts") != "" {
+			t.Errorf("Expected only min_ts to be used, got %v", query)
+		}
+	}
+
+	cached := []lastFm.Song{testListens[2199].song(), testListens[2200].song()}
+	fresh := newListens(cached, songs)
+	if len(fresh) != 299 || fresh[0].Title != "Song 2201" {
+		t.Errorf("Expected the cached song to be dropped, got %d songs starting with %s", len(fresh), fresh[0].Title)
+	}
+}
+
+// TestListensSharedSeconds checks that listens in the same second as the
+// end of a page aren't skipped or read twice.
+func TestListensSharedSeconds(t *testing.T) {
+	// Three listens a second means pages end partway through a second.
+	listens := make([]listen, 2500)
+	for i := range listens {
+		listens[i].ListenedAt = 1500000000 + int64(i/3)
+		listens[i].TrackMetadata.ArtistName = "Artist"
+		listens[i].TrackMetadata.TrackName = "Song " + strconv.Itoa(i)
+	}
+	server := newTestServer(listens, nil)
+	defer server.Close()
+	client := newTestClient(server.URL)
+
+	for _, since := range []time.Time{{}, time.Unix(listens[100].ListenedAt, 0)} {
+		songs, err := client.Listens(context.Background(), "someone", since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := len(listens)
+		if !since.IsZero() {
+			want -= 99 // listens 99 to 101 share a second.
+		}
+		titles := make(map[string]bool)
+		for _, song := range songs {
+			titles[song.Title] = true
+		}
+		if len(songs) != want || len(titles) != want {
+			t.Errorf("Expected %d different songs from %v, got %d songs and %d titles", want, since, len(songs), len(titles))
+		}
+		for i := 1; i < len(songs); i++ {
+			if songs[i].Timestamp.Before(songs[i-1].Timestamp) {
+				t.Fatalf("Songs %d and %d are out of order", i-1, i)
+			}
+		}
+	}
+}
+
+// TestListensError checks that an error from the API is returned.
+func TestListensError(t *testing.T) {
+	server := newTestServer(testListens, nil)
+	defer server.Close()
+
+	_, err := newTestClient(server.URL).Listens(context.Background(), "nobody", time.Time{})
+	if err == nil || !strings.Contains(err.Error(), "Cannot find user") {
+		t.Errorf("Expected the API's error, got %v", err)
+	}
+}
+
+// TestSource checks that the source reads the configured user's listens
+// and can be used as a history source.
+func TestSource(t *testing.T) {
+	useRedis := lastFm.UseRedis
+	lastFm.UseRedis = false
+	defer func() { lastFm.UseRedis = useRedis }()
+
+	server := newTestServer(testListens[:10], nil)
+	defer server.Close()
+
+	var source lastFm.HistorySource = Source{Client: newTestClient(server.URL), User: "someone"}
+	songs, err := source.History(context.Background(), "someone_else")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 10 || songs[0].Title != "Song 0" {
+		t.Errorf("Expected 10 songs starting with Song 0, got %v", songs)
+	}
+
+	empty := newTestServer(nil, nil)
+	defer empty.Close()
+	source = Source{Client: newTestClient(empty.URL)}
+	if _, err = source.History(context.Background(), "someone"); err == nil {
+		t.Error("Expected an error for a user with no listens")
+	}
+}
@@ -4,15 +4,21 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/csv"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/snyderks/spotkov/lastFm"
 	"github.com/snyderks/spotkov/markov"
+	"github.com/snyderks/spotkov/spotifyHistory"
 	"github.com/snyderks/spotkov/spotifyPlaylistGenerator"
 
 	"github.com/atotto/clipboard"
@@ -32,58 +38,98 @@ var (
 )
 
 type flags struct {
-	lastFmUserId   string
-	publicPlaylist bool
-	playlistLength int
-	song           string
-	artist         string
+	lastFmUserId    string
+	publicPlaylist  bool
+	playlistLength  int
+	song            string
+	artist          string
+	artistGap       int
+	maxArtistShare  float64
+	minArtists      int
+	topSongs        int
+	maxFromTop      int
+	fresh           time.Duration
+	freshWeight     float64
+	rediscover      int
+	rediscoverBoost float64
+	playlists       int
+	maxShared       int
+	export          string
+	order           int
+	minContext      int
+	feedbackWeight  float64
+	lovedBoost      float64
+	tags            string
+	excludeTags     string
+	lovedOnly       bool
+	since           time.Time
+	until           time.Time
+	source          *sourceFlags
 }
 
 func main() {
+	// subcommands have their own flags.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "alias":
+			runAlias(os.Args[2:])
+			return
+		case "diff":
+			runDiff(os.Args[2:])
+			return
+		case "feedback":
+			runFeedback(os.Args[2:])
+			return
+		case "import":
+			runImport(os.Args[2:])
+			return
+		case "sync":
+			runSync(os.Args[2:])
+			return
+		}
+	}
+
 	args, keep_going := handleArgs()
 	if keep_going == false {
 		return
 	}
-	// start a local HTTP server
-	http.HandleFunc("/callback", completeAuth) // paths ending in /callback call this!
-	/*http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Got request for:", r.URL.String())
-	})*/
-	go http.ListenAndServe(":8080", nil)
-
-	url := auth.AuthURL(state)
-	fmt.Println("Please log in to Spotify by visiting the following page\n(copied to your clipboard):\n\n", url)
-	clipboard.WriteAll(url)
-	//fmt.Println("Type yes to open this page in your browser, enter to continue")
-	//var openResp string
-	/*_, err := fmt.Scanf("%s\n", &openResp) // need the reference otherwise a copy is made
-	  if err == nil && strings.EqualFold(openResp, "yes") {
-	    fmt.Println("Opening in browser...")
-	    open(url)
-	  }*/ // this doesn't work right now; only first param is actually sent in url
-
-	// this assigns from the channel when it sees that the channel's been assigned to!
-	client := <-ch
+	var client *spotify.Client
+	var userID string
+	if args.export == "" {
+		client, userID = loginToSpotify()
+	}
 
-	// try and make a call that would fail if user wasn't logged in
-	user, err := client.CurrentUser()
+	source, err := args.source.historySource()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, stop := interruptContext()
+	titles, err := lastFm.HistoryBetween(ctx, source, args.lastFmUserId, args.since, args.until)
+	stop()
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("You are logged in as:", user.ID)
-
-	titles, _ := lastFm.ReadLastFMSongs(args.lastFmUserId)
 
+	if len(titles) == 0 && (!args.since.IsZero() || !args.until.IsZero()) {
+		log.Fatal("You didn't play anything in that range. Try a wider -since or -until.")
+	}
+	// Everything compared with the generated songs has to write them the
+	// same way the chain does.
+	aliases, _ := markov.ReadAliases(args.lastFmUserId)
+	titles = markov.Canonicalize(aliases.Apply(titles), aliases.Artists)
 	if len(titles) > 0 {
-		fmt.Println("Success! I got", len(titles), "titles from your Last.FM profile.")
+		fmt.Println("Success! I got", len(titles), "titles from your listening history.")
 	} else {
-		panic("No titles were returned from Last.FM. Cannot continue.")
+		panic("No titles were returned from your listening history. Cannot continue.")
 	}
 
-	chain := markov.BuildChain(titles)
+	var model markov.Model = markov.BuildFirstOrder(titles)
+	if args.order > 1 {
+		model = markov.BuildPPM(titles, args.order, args.minContext)
+	}
 	if args.song == "" && args.artist == "" {
 		reader := bufio.NewReader(os.Stdin)
-		lastSong := titles[0]
+		lastSong := titles[len(titles)-1]
 
 		fmt.Println("\nThe last song you played was", lastSong.Title, "by", lastSong.Artist)
 		fmt.Println("Use this as a starting point? (Yes/No) ")
@@ -135,11 +181,43 @@ func main() {
 	if args.playlistLength > 0 {
 		length = args.playlistLength
 	}
-	list, err := markov.GenerateSongList(length, 1, lastFm.Song{Artist: args.artist, Title: args.song}, chain)
+	opts := markov.Options{
+		Constraints: buildConstraints(args, titles),
+		Weights:     buildWeights(args, titles),
+	}
+	if feedback, err := markov.ReadFeedback(args.lastFmUserId); err == nil && args.feedbackWeight != 1 {
+		opts.Weights = append(opts.Weights, feedback.Weight(args.feedbackWeight))
+	}
+	if history, ok := source.(*spotifyHistory.Source); ok && args.source.skipsAsFeedback {
+		plays, _ := history.Plays()
+		opts.Weights = append(opts.Weights, spotifyHistory.SkipFeedback(plays, history.MinPlayed).Weight(args.feedbackWeight))
+	}
+	if args.lovedBoost != 1 || args.lovedOnly {
+		loved := lovedSongs(args.lastFmUserId, titles, aliases)
+		if args.lovedBoost != 1 {
+			opts.Weights = append(opts.Weights, markov.Loved(loved, args.lovedBoost))
+		}
+		if args.lovedOnly {
+			if len(loved) == 0 {
+				log.Fatal("You haven't loved any songs on Last.FM, so -lovedOnly can't be used.")
+			}
+			opts.Constraints = append(opts.Constraints, markov.LovedOnly(loved))
+		}
+	}
+	if args.tags != "" || args.excludeTags != "" {
+		opts.Constraints = append(opts.Constraints, tagConstraints(args, titles)...)
+	}
+	seed := lastFm.Song{Artist: args.artist, Title: args.song}
+	if !markov.Played(titles, seed) {
+		seed = bridgeSeed(seed, titles, model)
+	} else if !markov.Knows(model, seed) {
+		fmt.Println("\n"+seed.Title, "by", seed.Artist, "is in your history, but you've never played anything after it.")
+	}
+	lists, err := markov.GenerateSongListsFromModel(args.playlists, length, args.maxShared, seed, model, opts)
 	createPlaylist := true
 	if err != nil {
 		reader := bufio.NewReader(os.Stdin)
-		fmt.Println("An error was encountered when creating the list:", err)
+		fmt.Println("An error was encountered when creating the lists:", err)
 		fmt.Println("Go ahead and create the playlist anyway? (Yes/No)")
 		resp, _ := reader.ReadString('\n')
 		resp = strings.TrimSpace(resp)
@@ -159,8 +237,103 @@ func main() {
 		}
 	}
 	if createPlaylist == true {
-		spotifyPlaylistGenerator.CreatePlaylist(list, client, user.ID)
+		for i, list := range lists {
+			if args.export != "" {
+				err = exportPlaylist(args.export, i, list)
+			} else {
+				err = spotifyPlaylistGenerator.CreateNamedPlaylist(list, client, userID, playlistName(i))
+			}
+			if err != nil {
+				fmt.Println("Couldn't save playlist", i+1, "-", err)
+			}
+		}
+	}
+}
+
+// playlistName returns the name of the Spotify playlist to put the
+// playlist at index i into. The first keeps the original name.
+func playlistName(i int) string {
+	if i == 0 {
+		return spotifyPlaylistGenerator.PlaylistName
+	}
+	return fmt.Sprintf("%s (%d)", spotifyPlaylistGenerator.PlaylistName, i+1)
+}
+
+// exportPlaylist writes the playlist at index i to a CSV file of artists
+// and titles in the directory dir.
+func exportPlaylist(dir string, i int, list []lastFm.Song) error {
+	path := filepath.Join(dir, fmt.Sprintf("spotkov-%d.csv", i+1))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"artist", "title"})
+	for _, song := range list {
+		w.Write([]string{song.Artist, song.Title})
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return err
+	}
+	fmt.Println("Saved playlist", i+1, "to", path)
+	return nil
+}
+
+// interruptContext returns a context that's cancelled when the user presses
+// Ctrl-C, so long-running work can stop cleanly. Call stop once the work is
+// done to go back to exiting on Ctrl-C.
+func interruptContext() (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		select {
+		case <-interrupts:
+			fmt.Println("\nStopping...")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(interrupts)
+		cancel()
+	}
+}
+
+// loginToSpotify walks the user through logging in to Spotify and returns
+// a client for their account along with their user ID.
+func loginToSpotify() (*spotify.Client, string) {
+	// start a local HTTP server
+	http.HandleFunc("/callback", completeAuth) // paths ending in /callback call this!
+	/*http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		log.Println("Got request for:", r.URL.String())
+	})*/
+	go http.ListenAndServe(":8080", nil)
+
+	url := auth.AuthURL(state)
+	fmt.Println("Please log in to Spotify by visiting the following page\n(copied to your clipboard):\n\n", url)
+	clipboard.WriteAll(url)
+	//fmt.Println("Type yes to open this page in your browser, enter to continue")
+	//var openResp string
+	/*_, err := fmt.Scanf("%s\n", &openResp) // need the reference otherwise a copy is made
+	  if err == nil && strings.EqualFold(openResp, "yes") {
+	    fmt.Println("Opening in browser...")
+	    open(url)
+	  }*/ // this doesn't work right now; only first param is actually sent in url
+
+	// this assigns from the channel when it sees that the channel's been assigned to!
+	client := <-ch
+
+	// try and make a call that would fail if user wasn't logged in
+	user, err := client.CurrentUser()
+	if err != nil {
+		log.Fatal(err)
 	}
+	fmt.Println("You are logged in as:", user.ID)
+	return client, user.ID
 }
 
 func completeAuth(w http.ResponseWriter, r *http.Request) {
@@ -188,6 +361,28 @@ func handleArgs() (flags, bool) {
 	playlistLength := flag.Int("length", 20, "Length of the generated playlist")
 	songTitle := flag.String("title", "", "Title of the song to start with")
 	songArtist := flag.String("artist", "", "Artist of the song to start with")
+	artistGap := flag.Int("artistGap", 1, "Minimum number of songs between two songs by the same artist")
+	maxArtistShare := flag.Float64("maxArtistShare", 0, "Maximum fraction of the playlist by one artist, between 0 and 1 (0 for no limit)")
+	minArtists := flag.Int("minArtists", 0, "Minimum number of different artists in the playlist")
+	topSongs := flag.Int("topSongs", 50, "Number of your most played songs that -maxFromTop applies to")
+	maxFromTop := flag.Int("maxFromTop", -1, "Maximum number of your most played songs in the playlist (-1 for no limit)")
+	fresh := flag.Duration("fresh", 0, "Avoid songs played within this long, e.g. 48h (0 to allow them)")
+	freshWeight := flag.Float64("freshWeight", 0, "How likely songs avoided by -fresh are to be picked, from 0 (never) to 1 (as usual)")
+	rediscover := flag.Int("rediscover", 0, "Favor songs you haven't played in this many months (0 to turn off)")
+	rediscoverBoost := flag.Float64("rediscoverBoost", 4, "How much more likely songs favored by -rediscover are to be picked")
+	playlists := flag.Int("playlists", 1, "Number of playlists to generate")
+	maxShared := flag.Int("maxShared", 1, "Most playlists one song can be in when generating more than one (0 for no limit)")
+	order := flag.Int("order", 1, "Most previous songs to look at when picking the next one (more than 1 uses a variable-order model)")
+	minContext := flag.Int("minContext", 2, "Times a run of songs has to have been played before -order uses it")
+	lovedBoost := flag.Float64("lovedBoost", 1, "How much more likely songs you've loved on Last.FM are to be picked (1 to treat them like any other)")
+	tags := flag.String("tags", "", "Only use songs with one of these Last.FM tags, separated by commas, like 'shoegaze,dream pop'")
+	excludeTags := flag.String("excludeTags", "", "Leave out songs with any of these Last.FM tags, separated by commas, like 'christmas'")
+	lovedOnly := flag.Bool("lovedOnly", false, "Only use songs you've loved on Last.FM")
+	feedbackWeight := flag.Float64("feedbackWeight", 2, "How much each thumbs up or down from spotkov feedback changes how likely a song is (1 to ignore feedback)")
+	since := flag.String("since", "", "Only use songs played from the start of this year, month, or day on, like 2019-06")
+	until := flag.String("until", "", "Only use songs played until the end of this year, month, or day, like 2019-08")
+	source := addSourceFlags(flag.CommandLine)
+	export := flag.String("export", "", "Save the playlists as CSV files in this directory instead of adding them to Spotify")
 
 	flag.Parse()
 
@@ -199,9 +394,44 @@ func handleArgs() (flags, bool) {
 		fmt.Println("./spotkov -lastFm=your_Last.FM_user_id")
 		fmt.Println("./spotkov -lastFm=your_Last.FM_user_id -public")
 		fmt.Println("./spotkov -lastFm=your_Last.FM_user_id -length=45 -title=Madness -artist=Muse")
+		fmt.Println("./spotkov -lastFm=your_Last.FM_user_id -artistGap=3 -maxArtistShare=0.1 -minArtists=15 -maxFromTop=5")
+		fmt.Println("./spotkov -lastFm=your_Last.FM_user_id -fresh=72h -rediscover=6")
+		fmt.Println("./spotkov -lastFm=your_Last.FM_user_id -playlists=3 -maxShared=1 -export=./playlists")
+		fmt.Println("./spotkov -lastFm=your_Last.FM_user_id -order=3")
+		fmt.Println("./spotkov -lastFm=your_Last.FM_user_id -lovedBoost=3")
+		fmt.Println("./spotkov -lastFm=your_Last.FM_user_id -tags='shoegaze,dream pop' -excludeTags=christmas")
+		fmt.Println("./spotkov -lastFm=your_Last.FM_user_id -lovedOnly -title=Reckoner -artist=Radiohead")
+		fmt.Println("./spotkov -lastFm=your_Last.FM_user_id -title='Song You Have Never Played' -artist='Some Band'")
+		fmt.Println("./spotkov -lastFm=your_Last.FM_user_id -since=2019-06 -until=2019-08")
+		fmt.Println("./spotkov diff -lastFm=your_Last.FM_user_id -from=2016 -to=2017")
+		fmt.Println("./spotkov -lastFm=your_Last.FM_user_id -spotifyHistory='MyData/Streaming_History_Audio_*.json' -minPlayed=45s -skipsAsFeedback")
+		fmt.Println("./spotkov -lastFm=your_Last.FM_user_id -source=listenbrainz -listenBrainz=your_ListenBrainz_user")
+		fmt.Println("./spotkov import -lastFm=your_Last.FM_user_id -csv=scrobbles.csv -tz=America/New_York")
+		fmt.Println("./spotkov sync -lastFm=your_Last.FM_user_id -verify")
+		fmt.Println("./spotkov alias suggest -lastFm=your_Last.FM_user_id")
+		fmt.Println("./spotkov alias add -lastFm=your_Last.FM_user_id -artist='Prince & The Revolution' -toArtist=Prince")
+		fmt.Println("./spotkov alias add -lastFm=your_Last.FM_user_id -artist=Muse -title='Madnes' -toArtist=Muse -toTitle=Madness")
+		fmt.Println("./spotkov feedback -lastFm=your_Last.FM_user_id -down -afterTitle=Madness -afterArtist=Muse -title=Roads -artist=Portishead")
 		return flags{}, false
 	}
 
+	if *since != "" {
+		p, err := parsePeriod(*since)
+		if err != nil {
+			fmt.Println(err)
+			return allFlags, false
+		}
+		allFlags.since = p.Start
+	}
+	if *until != "" {
+		p, err := parsePeriod(*until)
+		if err != nil {
+			fmt.Println(err)
+			return allFlags, false
+		}
+		allFlags.until = p.End
+	}
+
 	if *lastFm == "" {
 		var userId string
 		fmt.Printf("Please enter your Last.FM user ID: ")
@@ -218,11 +448,54 @@ func handleArgs() (flags, bool) {
 	allFlags.playlistLength = *playlistLength
 	allFlags.song = *songTitle
 	allFlags.artist = *songArtist
+	allFlags.artistGap = *artistGap
+	allFlags.maxArtistShare = *maxArtistShare
+	allFlags.minArtists = *minArtists
+	allFlags.topSongs = *topSongs
+	allFlags.maxFromTop = *maxFromTop
+	allFlags.fresh = *fresh
+	allFlags.freshWeight = *freshWeight
+	allFlags.rediscover = *rediscover
+	allFlags.rediscoverBoost = *rediscoverBoost
+	allFlags.playlists = *playlists
+	allFlags.maxShared = *maxShared
+	allFlags.export = *export
+	allFlags.order = *order
+	allFlags.minContext = *minContext
+	allFlags.feedbackWeight = *feedbackWeight
+	allFlags.lovedBoost = *lovedBoost
+	allFlags.lovedOnly = *lovedOnly
+	allFlags.tags = *tags
+	allFlags.excludeTags = *excludeTags
+	allFlags.source = source
+	if allFlags.playlists < 1 {
+		allFlags.playlists = 1
+	}
 
 	return allFlags, true
 
 }
 
+// buildConstraints turns the diversity flags into the constraints that
+// every generated song has to satisfy.
+func buildConstraints(args flags, titles []lastFm.Song) markov.Constraints {
+	constraints := markov.Constraints{markov.NoRepeats()}
+	if args.artistGap > 0 {
+		constraints = append(constraints, markov.MinArtistGap(args.artistGap))
+	}
+	if args.maxArtistShare > 0 {
+		constraints = append(constraints, markov.MaxArtistShare(args.maxArtistShare))
+	}
+	if args.minArtists > 0 {
+		constraints = append(constraints, markov.MinDistinctArtists(args.minArtists))
+	}
+	if args.topSongs > 0 && args.maxFromTop >= 0 {
+		top := markov.TopSongs(titles, args.topSongs)
+		constraints = append(constraints, markov.MaxFromTopSongs(top, args.maxFromTop))
+	}
+	return constraints
+}
+
 func checkYesOrNo(resp string) (result, valid bool) {
 	if strings.EqualFold(resp, "yes") || strings.EqualFold(resp, "y") {
 		return true, true
@@ -233,3 +506,106 @@ func checkYesOrNo(resp string) (result, valid bool) {
 		return false, false
 	}
 }
+
+// lovedSongs returns the songs the user has loved on Last.FM, along with
+// any the listening history says are loved.
+func lovedSongs(user string, titles []lastFm.Song, aliases markov.Aliases) map[lastFm.BaseSong]bool {
+	ctx, stop := interruptContext()
+	defer stop()
+	lovedTracks, err := lastFm.ReadLovedTracks(ctx, user, lastFm.FetchOptions{})
+	if err != nil {
+		fmt.Println("Couldn't get your loved tracks from Last.FM:", err)
+	}
+	// Loved tracks are written the same way as the history, which is
+	// already canonical, by making them canonical along with it.
+	all := markov.Canonicalize(append(titles[:len(titles):len(titles)], aliases.Apply(lovedTracks)...), aliases.Artists)
+	return markov.LovedSongs(all)
+}
+
+// tagConstraints looks up the tags of every song in the history and
+// returns constraints for the -tags and -excludeTags flags.
+func tagConstraints(args flags, titles []lastFm.Song) markov.Constraints {
+	seen := make(map[lastFm.BaseSong]bool)
+	songs := make([]lastFm.BaseSong, 0)
+	for _, title := range titles {
+		song := lastFm.BaseSong{Artist: title.Artist, Title: title.Title}
+		if !seen[song] {
+			seen[song] = true
+			songs = append(songs, song)
+		}
+	}
+	fmt.Println("Looking up tags for", len(songs), "songs. They're cached, so this is only slow the first time.")
+	ctx, stop := interruptContext()
+	defer stop()
+	opts := lastFm.FetchOptions{Progress: printProgress("tag lists")}
+	tags, err := lastFm.ReadTags(ctx, songs, opts)
+	if err != nil {
+		log.Fatal("Couldn't get tags from Last.FM: ", err)
+	}
+
+	constraints := markov.Constraints{}
+	if include := splitTags(args.tags); len(include) > 0 {
+		constraints = append(constraints, markov.Tagged(tags, include...))
+	}
+	if exclude := splitTags(args.excludeTags); len(exclude) > 0 {
+		constraints = append(constraints, markov.NotTagged(tags, exclude...))
+	}
+	return constraints
+}
+
+// bridgeSeed finds the song in the history that's most like seed, for
+// when seed itself has never been played. Last.FM's similar songs are
+// tried first, then songs by the same artist, then by similar artists.
+// seed is returned as it is if nothing suitable is found.
+func bridgeSeed(seed lastFm.Song, titles []lastFm.Song, model markov.Model) lastFm.Song {
+	ctx, stop := interruptContext()
+	defer stop()
+	opts := lastFm.FetchOptions{}
+	similar, err := lastFm.SimilarTracks(ctx, lastFm.BaseSong{Artist: seed.Artist, Title: seed.Title}, opts)
+	if err != nil {
+		fmt.Println("Couldn't get similar songs from Last.FM:", err)
+	}
+	artists := []string{seed.Artist}
+	similarArtists, err := lastFm.SimilarArtists(ctx, seed.Artist, opts)
+	if err != nil {
+		fmt.Println("Couldn't get similar artists from Last.FM:", err)
+	}
+	artists = append(artists, similarArtists...)
+
+	bridge, ok := markov.Bridge(model, titles, markov.BridgeCandidates(titles, similar, artists))
+	if !ok {
+		fmt.Println("\n"+seed.Title, "by", seed.Artist, "isn't in your history, and neither is anything like it.")
+		return seed
+	}
+	fmt.Println("\n"+seed.Title, "by", seed.Artist, "isn't in your history, so I'll start from the most similar song you've played:",
+		bridge.Title, "by", bridge.Artist)
+	return bridge
+}
+
+// splitTags splits a comma-separated list of tags.
+func splitTags(list string) []string {
+	tags := make([]string, 0)
+	for _, tag := range strings.Split(list, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// buildWeights turns the freshness flags into weights for the generator.
+func buildWeights(args flags, titles []lastFm.Song) markov.Weights {
+	weights := markov.Weights{}
+	if args.fresh <= 0 && args.rediscover <= 0 {
+		return weights
+	}
+	lastPlayed := markov.LastPlayed(titles)
+	now := time.Now()
+	if args.fresh > 0 {
+		weights = append(weights, markov.Freshness(lastPlayed, now.Add(-args.fresh), args.freshWeight))
+	}
+	if args.rediscover > 0 {
+		weights = append(weights, markov.Rediscover(lastPlayed, now.AddDate(0, -args.rediscover, 0), args.rediscoverBoost))
+	}
+	return weights
+}
@@ -0,0 +1,259 @@
+package markov
+
+import (
+	"sort"
+	"unicode/utf8"
+
+	"github.com/snyderks/spotkov/lastFm"
+	"github.com/snyderks/spotkov/tools"
+)
+
+// aliasCachePrefix is the Redis key prefix for a user's aliases.
+const aliasCachePrefix = "aliasCache."
+
+// Aliases is a user's table of other ways a song or artist is written,
+// for the ones Canonicalize can't tell are the same. Variants are stored
+// in their canonical form, so an alias covers every way of writing them.
+type Aliases struct {
+	// Songs maps a variant of a song to the song to use instead.
+	Songs map[tools.SongKey]lastFm.BaseSong
+	// Artists maps a variant of an artist's name to the name to use
+	// instead, for all of their songs. They're used by passing them to
+	// Canonicalize.
+	Artists tools.ArtistAliases
+}
+
+// Suggestion is a pair of songs, or artists when the titles are empty,
+// that might be the same.
+type Suggestion struct {
+	From, To   lastFm.BaseSong
+	Similarity float64
+}
+
+// NewAliases returns a table without any aliases.
+func NewAliases() Aliases {
+	return Aliases{
+		Songs:   make(map[tools.SongKey]lastFm.BaseSong),
+		Artists: make(tools.ArtistAliases),
+	}
+}
+
+// ReadAliases reads back a user's aliases from the cache.
+// It returns an empty table along with the error if there isn't one.
+func ReadAliases(userID string) (Aliases, error) {
+	a := Aliases{}
+	err := lastFm.ReadCache(userID, aliasCachePrefix, &a)
+	if err != nil {
+		return NewAliases(), err
+	}
+	// gob leaves out empty maps.
+	if a.Songs == nil {
+		a.Songs = make(map[tools.SongKey]lastFm.BaseSong)
+	}
+	if a.Artists == nil {
+		a.Artists = make(tools.ArtistAliases)
+	}
+	return a, nil
+}
+
+// WriteAliases saves a user's aliases to the cache.
+func WriteAliases(userID string, a Aliases) error {
+	return lastFm.WriteCache(userID, aliasCachePrefix, a)
+}
+
+// AddSong makes variant another way of writing song. If song is itself an
+// alias, variant goes to what it stands for, and aliases that went to variant
+// go to song instead, so the table never needs more than one lookup.
+func (a Aliases) AddSong(variant, song lastFm.BaseSong) {
+	from := tools.Canonical(variant.Artist, variant.Title)
+	to := tools.Canonical(song.Artist, song.Title)
+	if next, ok := a.Songs[to]; ok {
+		if tools.Canonical(next.Artist, next.Title) == from {
+			// Turning an alias around.
+			delete(a.Songs, to)
+		} else {
+			song, to = next, tools.Canonical(next.Artist, next.Title)
+		}
+	}
+	for key, target := range a.Songs {
+		if tools.Canonical(target.Artist, target.Title) == from {
+			a.Songs[key] = song
+		}
+	}
+	if from == to {
+		delete(a.Songs, from)
+		return
+	}
+	a.Songs[from] = song
+}
+
+// AddArtist makes variant another way of writing artist, resolving chains of
+// aliases the same way AddSong does.
+func (a Aliases) AddArtist(variant, artist string) {
+	from, to := tools.CanonicalArtist(variant), tools.CanonicalArtist(artist)
+	if next, ok := a.Artists[to]; ok {
+		if next == from {
+			delete(a.Artists, to)
+		} else {
+			to = next
+		}
+	}
+	for key, target := range a.Artists {
+		if target == from {
+			a.Artists[key] = to
+		}
+	}
+	if from == to {
+		delete(a.Artists, from)
+		return
+	}
+	a.Artists[from] = to
+}
+
+// RemoveSong removes the alias for variant, and reports whether there was one.
+func (a Aliases) RemoveSong(variant lastFm.BaseSong) bool {
+	key := tools.Canonical(variant.Artist, variant.Title)
+	_, ok := a.Songs[key]
+	delete(a.Songs, key)
+	return ok
+}
+
+// RemoveArtist removes the alias for variant, and reports whether there was one.
+func (a Aliases) RemoveArtist(variant string) bool {
+	key := tools.CanonicalArtist(variant)
+	_, ok := a.Artists[key]
+	delete(a.Artists, key)
+	return ok
+}
+
+// Apply returns a copy of songs with every song variant in the table
+// replaced by the song it's an alias of. Artist aliases are left to
+// Canonicalize.
+func (a Aliases) Apply(songs []lastFm.Song) []lastFm.Song {
+	applied := make([]lastFm.Song, len(songs))
+	for i, song := range songs {
+		if to, ok := a.Songs[tools.Canonical(song.Artist, song.Title)]; ok {
+			song.Artist, song.Title = to.Artist, to.Title
+		}
+		applied[i] = song
+	}
+	return applied
+}
+
+// SuggestAliases looks through a user's listening history for songs that
+// are probably the same, but that Canonicalize doesn't treat as the same.
+// Songs by the same artist are suggested when their titles are at least
+// minSimilarity alike, and so are artists whose names are. Each suggestion
+// is from the one played less to the one played more, since that's more
+// likely to be written right. Aliases already in the table are applied
+// first, so they aren't suggested again.
+// The most alike are first.
+func (a Aliases) SuggestAliases(history []lastFm.Song, minSimilarity float64) []Suggestion {
+	plays := make(map[lastFm.BaseSong]int)
+	for _, song := range a.Apply(history) {
+		plays[lastFm.BaseSong{Artist: song.Artist, Title: song.Title}]++
+	}
+	titles := make(map[string]map[string]*variant)
+	artists := make(map[string]*variant)
+	for song, n := range plays {
+		key := a.Artists.Canonical(song.Artist, song.Title)
+		if titles[key.Artist] == nil {
+			titles[key.Artist] = make(map[string]*variant)
+		}
+		titles[key.Artist][key.Title] = titles[key.Artist][key.Title].add(song, n)
+		artists[key.Artist] = artists[key.Artist].add(lastFm.BaseSong{Artist: song.Artist}, n)
+	}
+
+	suggestions := make([]Suggestion, 0)
+	for _, byTitle := range titles {
+		suggestions = append(suggestions, suggest(byTitle, minSimilarity)...)
+	}
+	suggestions = append(suggestions, suggest(artists, minSimilarity)...)
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Similarity != suggestions[j].Similarity {
+			return suggestions[i].Similarity > suggestions[j].Similarity
+		}
+		if suggestions[i].From.Artist != suggestions[j].From.Artist {
+			return suggestions[i].From.Artist < suggestions[j].From.Artist
+		}
+		return suggestions[i].From.Title < suggestions[j].From.Title
+	})
+	return suggestions
+}
+
+// variant is every way of writing a song or artist that has the same key,
+// written the way it was played the most.
+type variant struct {
+	song  lastFm.BaseSong
+	most  int // plays of song
+	plays int // plays of every way of writing it
+}
+
+// add counts n plays of song, which can be another way of writing v.
+// v can be nil.
+func (v *variant) add(song lastFm.BaseSong, n int) *variant {
+	if v == nil {
+		v = &variant{}
+	}
+	v.plays += n
+	if n > v.most || (n == v.most && lessSong(song, v.song)) {
+		v.song, v.most = song, n
+	}
+	return v
+}
+
+// lessSong orders songs by artist and then title.
+func lessSong(a, b lastFm.BaseSong) bool {
+	if a.Artist != b.Artist {
+		return a.Artist < b.Artist
+	}
+	return a.Title < b.Title
+}
+
+// suggest returns a suggestion for every pair of variants whose keys are
+// at least minSimilarity alike, from the one played less.
+func suggest(variants map[string]*variant, minSimilarity float64) []Suggestion {
+	keys := make([]string, 0, len(variants))
+	for key := range variants {
+		keys = append(keys, key)
+	}
+	suggestions := make([]Suggestion, 0)
+	for _, pair := range similarPairs(keys, minSimilarity) {
+		from, to := variants[pair.a], variants[pair.b]
+		if from.plays > to.plays {
+			from, to = to, from
+		}
+		suggestions = append(suggestions, Suggestion{From: from.song, To: to.song, Similarity: pair.similarity})
+	}
+	return suggestions
+}
+
+// similarPair is two keys that are alike.
+type similarPair struct {
+	a, b       string
+	similarity float64
+}
+
+// similarPairs returns every pair of keys that are at least minSimilarity
+// alike, with the keys of each pair in order.
+func similarPairs(keys []string, minSimilarity float64) []similarPair {
+	sort.Strings(keys)
+	pairs := make([]similarPair, 0)
+	for i, a := range keys {
+		for _, b := range keys[i+1:] {
+			// Strings can't be more alike than their lengths allow.
+			la, lb := float64(utf8.RuneCountInString(a)), float64(utf8.RuneCountInString(b))
+			if la > lb {
+				la, lb = lb, la
+			}
+			if lb == 0 || la/lb < minSimilarity {
+				continue
+			}
+			if similarity := tools.Similarity(a, b); similarity >= minSimilarity {
+				pairs = append(pairs, similarPair{a, b, similarity})
+			}
+		}
+	}
+	return pairs
+}
@@ -0,0 +1,94 @@
+package markov
+
+import (
+	"sort"
+
+	"github.com/snyderks/spotkov/lastFm"
+	"github.com/snyderks/spotkov/tools"
+)
+
+// Played reports whether song, or another way of writing it, is in history.
+// A song can be played without the model knowing it, if it's the last one
+// played or nothing after it was linked to it.
+func Played(history []lastFm.Song, song lastFm.Song) bool {
+	key := tools.Canonical(song.Artist, song.Title)
+	for _, s := range history {
+		if tools.Canonical(s.Artist, s.Title) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Knows reports whether the model can pick a song to follow song.
+// Like the model, it looks for songs written a bit differently too.
+func Knows(model Model, song lastFm.Song) bool {
+	_, err := model.Next([]lastFm.Song{song})
+	return err == nil
+}
+
+// exactModel is a Model that can tell whether it knows a song as it's
+// written, without looking for ones like it.
+type exactModel interface {
+	knowsExactly(song lastFm.BaseSong) bool
+}
+
+// Bridge returns the first of candidates that was played in history and
+// that the model knows, so that a playlist can start from there when the
+// song asked for isn't in the listening history. The song is written the
+// way it is in history.
+func Bridge(model Model, history []lastFm.Song, candidates []lastFm.Song) (lastFm.Song, bool) {
+	played := make(map[tools.SongKey]lastFm.Song, len(history))
+	for _, s := range history {
+		played[tools.Canonical(s.Artist, s.Title)] = s
+	}
+	for _, c := range candidates {
+		song, ok := played[tools.Canonical(c.Artist, c.Title)]
+		if !ok {
+			continue
+		}
+		if exact, ok := model.(exactModel); ok {
+			if exact.knowsExactly(lastFm.BaseSong{Artist: song.Artist, Title: song.Title}) {
+				return song, true
+			}
+		} else if Knows(model, song) {
+			return song, true
+		}
+	}
+	return lastFm.Song{}, false
+}
+
+// BridgeCandidates orders the songs to try as a bridge: similar songs in
+// the order given, then the songs in history by each of the artists in
+// turn, most played first.
+func BridgeCandidates(history []lastFm.Song, similar []lastFm.BaseSong, artists []string) []lastFm.Song {
+	candidates := make([]lastFm.Song, 0, len(similar))
+	for _, s := range similar {
+		candidates = append(candidates, lastFm.Song{Artist: s.Artist, Title: s.Title})
+	}
+
+	plays := make(map[string]map[lastFm.BaseSong]int)
+	for _, song := range history {
+		if plays[song.Artist] == nil {
+			plays[song.Artist] = make(map[lastFm.BaseSong]int)
+		}
+		plays[song.Artist][lastFm.BaseSong{Artist: song.Artist, Title: song.Title}]++
+	}
+	for _, artist := range artists {
+		byArtist := make([]lastFm.BaseSong, 0, len(plays[artist]))
+		for s := range plays[artist] {
+			byArtist = append(byArtist, s)
+		}
+		sort.Slice(byArtist, func(i, j int) bool {
+			a, b := plays[artist][byArtist[i]], plays[artist][byArtist[j]]
+			if a != b {
+				return a > b
+			}
+			return byArtist[i].Title < byArtist[j].Title
+		})
+		for _, s := range byArtist {
+			candidates = append(candidates, lastFm.Song{Artist: s.Artist, Title: s.Title})
+		}
+	}
+	return candidates
+}
@@ -0,0 +1,88 @@
+package markov
+
+import (
+	"github.com/snyderks/spotkov/lastFm"
+	"github.com/snyderks/spotkov/tools"
+)
+
+// canonicalSongs remembers how each song is written in a chain, so that
+// every other way of writing it can be made the same.
+type canonicalSongs struct {
+	artists tools.ArtistAliases
+	names   map[string]string // how each artist's own name is written
+	songs   map[tools.SongKey]lastFm.BaseSong
+	seen    map[lastFm.BaseSong]lastFm.BaseSong // memoizes song
+}
+
+// newCanonicalSongs returns an empty canonicalSongs that keys songs with
+// artists' aliases, which can be nil.
+func newCanonicalSongs(artists tools.ArtistAliases) *canonicalSongs {
+	return &canonicalSongs{
+		artists: artists,
+		names:   make(map[string]string),
+		songs:   make(map[tools.SongKey]lastFm.BaseSong),
+		seen:    make(map[lastFm.BaseSong]lastFm.BaseSong),
+	}
+}
+
+// song returns song written the same way as the other versions of it.
+// The first version seen decides how that is, without any featured
+// artists or suffixes like "Remastered". Songs by an alias of an artist
+// use the artist's own name instead, once it's been seen.
+func (c *canonicalSongs) song(song lastFm.Song) lastFm.Song {
+	raw := lastFm.BaseSong{Artist: song.Artist, Title: song.Title}
+	base, ok := c.seen[raw]
+	if !ok {
+		key := c.artists.Canonical(song.Artist, song.Title)
+		if base, ok = c.songs[key]; !ok {
+			base = lastFm.BaseSong{Artist: tools.MainArtist(song.Artist), Title: tools.ParseTitle(song.Title).Base}
+			if base.Artist == "" || base.Title == "" {
+				base = raw
+			}
+			if _, aliased := c.artists[tools.CanonicalArtist(song.Artist)]; !aliased {
+				if _, named := c.names[key.Artist]; !named {
+					c.names[key.Artist] = base.Artist
+				}
+			} else if name, named := c.names[key.Artist]; named {
+				base.Artist = name
+			}
+			c.songs[key] = base
+		}
+		c.seen[raw] = base
+	}
+	song.Artist, song.Title = base.Artist, base.Title
+	return song
+}
+
+// titles returns the canonical title of every song in chain, and every
+// other way of writing it that's been seen, mapped to its key in chain.
+func (c *canonicalSongs) titles(chain map[string]Suffixes) map[string]string {
+	titles := make(map[string]string, len(chain))
+	for key, base := range c.songs {
+		if _, ok := chain[base.Title]; ok {
+			titles[key.Title] = base.Title
+		}
+	}
+	return titles
+}
+
+// all returns a copy of songs with each one made canonical.
+func (c *canonicalSongs) all(songs []lastFm.Song) []lastFm.Song {
+	canonical := make([]lastFm.Song, len(songs))
+	for i, song := range songs {
+		canonical[i] = c.song(song)
+	}
+	return canonical
+}
+
+// Canonicalize returns a copy of songs where every way of writing a song,
+// like "Song - Remastered 2011" or "Song (feat. X)", is written the same
+// way. Songs are keyed by artists.Canonical, so an artist's songs are the
+// same under any of their aliases, and are written like the first version
+// of them in songs without the suffixes. artists can be nil.
+// BuildChain and BuildPPM do this themselves without any aliases, but
+// other things that are compared with the songs they generate should use
+// it too.
+func Canonicalize(songs []lastFm.Song, artists tools.ArtistAliases) []lastFm.Song {
+	return newCanonicalSongs(artists).all(songs)
+}
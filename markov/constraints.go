@@ -0,0 +1,174 @@
+package markov
+
+import (
+	"math"
+	"sort"
+
+	"github.com/snyderks/spotkov/lastFm"
+)
+
+// Constraint decides whether a song may be added to a playlist.
+type Constraint interface {
+	// Allow reports whether song may be appended to list in a playlist
+	// that will end up length songs long.
+	Allow(list []lastFm.Song, song lastFm.Song, length int) bool
+}
+
+// ConstraintFunc allows an ordinary function to be used as a Constraint.
+type ConstraintFunc func(list []lastFm.Song, song lastFm.Song, length int) bool
+
+// Allow calls f(list, song, length).
+func (f ConstraintFunc) Allow(list []lastFm.Song, song lastFm.Song, length int) bool {
+	return f(list, song, length)
+}
+
+// Constraints is a set of constraints that all have to allow a song.
+type Constraints []Constraint
+
+// Allow reports whether every constraint in the set allows the song.
+// Constraints are checked in order and checking stops at the first one
+// that doesn't allow it.
+func (cs Constraints) Allow(list []lastFm.Song, song lastFm.Song, length int) bool {
+	for _, c := range cs {
+		if !c.Allow(list, song, length) {
+			return false
+		}
+	}
+	return true
+}
+
+// NoRepeats doesn't allow a song that's already in the playlist.
+func NoRepeats() Constraint {
+	return ConstraintFunc(func(list []lastFm.Song, song lastFm.Song, length int) bool {
+		return !isDuplicate(list, song)
+	})
+}
+
+// MaxBySameArtist doesn't allow more than max songs by one artist in a row.
+func MaxBySameArtist(max int) Constraint {
+	return ConstraintFunc(func(list []lastFm.Song, song lastFm.Song, length int) bool {
+		return !isRepeatArtist(list, song, max)
+	})
+}
+
+// MinArtistGap requires at least gap other songs between two songs by the
+// same artist. A gap of 1 means an artist is never played twice in a row.
+func MinArtistGap(gap int) Constraint {
+	return ConstraintFunc(func(list []lastFm.Song, song lastFm.Song, length int) bool {
+		for i := len(list) - 1; i >= 0 && i >= len(list)-gap; i-- {
+			if list[i].Artist == song.Artist {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// MaxArtistShare limits the fraction of the playlist taken up by any one
+// artist. Every artist is allowed at least one song.
+func MaxArtistShare(share float64) Constraint {
+	return ConstraintFunc(func(list []lastFm.Song, song lastFm.Song, length int) bool {
+		limit := int(math.Floor(share * float64(length)))
+		if limit < 1 {
+			limit = 1
+		}
+		count := 1 // the song being added
+		for _, s := range list {
+			if s.Artist == song.Artist {
+				count++
+			}
+		}
+		return count <= limit
+	})
+}
+
+// MinDistinctArtists requires the finished playlist to have songs by at
+// least min different artists. Once the remaining space is needed to reach
+// the minimum, only songs by artists not yet in the playlist are allowed.
+func MinDistinctArtists(min int) Constraint {
+	return ConstraintFunc(func(list []lastFm.Song, song lastFm.Song, length int) bool {
+		artists := make(map[string]bool, len(list))
+		for _, s := range list {
+			artists[s.Artist] = true
+		}
+		if !artists[song.Artist] {
+			return true
+		}
+		// the song takes a slot without adding an artist.
+		remaining := length - len(list) - 1
+		return len(artists)+remaining >= min
+	})
+}
+
+// MaxFromTopSongs allows at most max songs from the set of top songs
+// in the playlist. TopSongs can be used to build the set.
+func MaxFromTopSongs(top map[lastFm.BaseSong]bool, max int) Constraint {
+	return ConstraintFunc(func(list []lastFm.Song, song lastFm.Song, length int) bool {
+		if !top[lastFm.BaseSong{Artist: song.Artist, Title: song.Title}] {
+			return true
+		}
+		count := 1 // the song being added
+		for _, s := range list {
+			if top[lastFm.BaseSong{Artist: s.Artist, Title: s.Title}] {
+				count++
+			}
+		}
+		return count <= max
+	})
+}
+
+// LovedOnly only allows loved songs, so the playlist is made of the loved
+// songs that can be reached from the first through the chain.
+// LovedSongs can be used to build the set.
+func LovedOnly(loved map[lastFm.BaseSong]bool) Constraint {
+	return ConstraintFunc(func(list []lastFm.Song, song lastFm.Song, length int) bool {
+		return loved[lastFm.BaseSong{Artist: song.Artist, Title: song.Title}]
+	})
+}
+
+// Tagged only allows songs with at least one of the tags.
+// lastFm.ReadTags can be used to look up the tags of songs.
+func Tagged(tags lastFm.Tags, include ...string) Constraint {
+	return ConstraintFunc(func(list []lastFm.Song, song lastFm.Song, length int) bool {
+		return tags.Has(lastFm.BaseSong{Artist: song.Artist, Title: song.Title}, include...)
+	})
+}
+
+// NotTagged leaves out songs with any of the tags.
+func NotTagged(tags lastFm.Tags, exclude ...string) Constraint {
+	return ConstraintFunc(func(list []lastFm.Song, song lastFm.Song, length int) bool {
+		return !tags.Has(lastFm.BaseSong{Artist: song.Artist, Title: song.Title}, exclude...)
+	})
+}
+
+// TopSongs returns the n most played songs in a listening history.
+// Songs played the same number of times are ordered by artist and title
+// so that the result doesn't change between calls.
+func TopSongs(songs []lastFm.Song, n int) map[lastFm.BaseSong]bool {
+	plays := make(map[lastFm.BaseSong]int)
+	for _, song := range songs {
+		plays[lastFm.BaseSong{Artist: song.Artist, Title: song.Title}]++
+	}
+	ranked := make([]lastFm.BaseSong, 0, len(plays))
+	for song := range plays {
+		ranked = append(ranked, song)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if plays[a] != plays[b] {
+			return plays[a] > plays[b]
+		}
+		if a.Artist != b.Artist {
+			return a.Artist < b.Artist
+		}
+		return a.Title < b.Title
+	})
+	if n < len(ranked) {
+		ranked = ranked[:n]
+	}
+	top := make(map[lastFm.BaseSong]bool, len(ranked))
+	for _, song := range ranked {
+		top[song] = true
+	}
+	return top
+}
@@ -0,0 +1,224 @@
+package markov
+
+import (
+	"math"
+	"sort"
+
+	"github.com/snyderks/spotkov/lastFm"
+)
+
+// Transition is one song being played after another.
+type Transition struct {
+	From lastFm.BaseSong `json:"from"`
+	To   lastFm.BaseSong `json:"to"`
+}
+
+// TransitionChange is how likely a transition was in two chains.
+type TransitionChange struct {
+	Transition
+	Before float64 `json:"before"` // probability of To following From in the first chain
+	After  float64 `json:"after"`  // probability of To following From in the second chain
+}
+
+// Change is how much more likely the transition became.
+// It's negative if the transition became less likely.
+func (c TransitionChange) Change() float64 {
+	return c.After - c.Before
+}
+
+// SongChange is how big a share of the plays in two chains a song had.
+type SongChange struct {
+	lastFm.BaseSong
+	Before float64 `json:"before"` // share of the plays in the first chain
+	After  float64 `json:"after"`  // share of the plays in the second chain
+}
+
+// Change is how much bigger the song's share became.
+// It's negative if the share became smaller.
+func (c SongChange) Change() float64 {
+	return c.After - c.Before
+}
+
+// ChainDiff describes how one chain changed into another.
+// Every list is sorted with the biggest changes first.
+type ChainDiff struct {
+	NewSongs           []lastFm.BaseSong  `json:"newSongs"`
+	DroppedSongs       []lastFm.BaseSong  `json:"droppedSongs"`
+	ChangedSongs       []SongChange       `json:"changedSongs"`
+	NewTransitions     []TransitionChange `json:"newTransitions"`
+	DroppedTransitions []TransitionChange `json:"droppedTransitions"`
+	ChangedTransitions []TransitionChange `json:"changedTransitions"`
+}
+
+// DiffHistories builds a chain from each of two listening histories, such
+// as two different periods, and compares them like DiffChains. Songs are
+// made canonical across both, so they're written the same way in each,
+// and the artist of every song comes from the histories.
+func DiffHistories(from, to []lastFm.Song) ChainDiff {
+	canon := newCanonicalSongs(nil)
+	from, to = canon.all(from), canon.all(to)
+	artists := make(map[string]string)
+	for _, songs := range [][]lastFm.Song{from, to} {
+		for _, song := range songs {
+			if _, ok := artists[song.Title]; !ok {
+				artists[song.Title] = song.Artist
+			}
+		}
+	}
+	return diffChains(buildChain(from, canon), buildChain(to, canon), artists)
+}
+
+// DiffChains compares two chains, such as chains built from two different
+// periods of listening history, and reports which songs and transitions
+// appeared, disappeared, or changed probability between them.
+// Songs are ordered by how many times they were played in the chain they
+// appear in. Chains are keyed by title alone, so the artist of a song that
+// was only ever played first is left empty; DiffHistories doesn't have
+// that problem.
+func DiffChains(from, to map[string]Suffixes) ChainDiff {
+	return diffChains(from, to, nil)
+}
+
+// diffChains is DiffChains, with the artist of each title in artists.
+func diffChains(from, to map[string]Suffixes, artists map[string]string) ChainDiff {
+	before := transitionProbabilities(from, artists)
+	after := transitionProbabilities(to, artists)
+	diff := ChainDiff{}
+
+	for t, p := range after {
+		if q, ok := before[t]; !ok {
+			diff.NewTransitions = append(diff.NewTransitions, TransitionChange{t, 0, p})
+		} else if p != q {
+			diff.ChangedTransitions = append(diff.ChangedTransitions, TransitionChange{t, q, p})
+		}
+	}
+	for t, q := range before {
+		if _, ok := after[t]; !ok {
+			diff.DroppedTransitions = append(diff.DroppedTransitions, TransitionChange{t, q, 0})
+		}
+	}
+	sortChanges(diff.NewTransitions)
+	sortChanges(diff.DroppedTransitions)
+	sortChanges(diff.ChangedTransitions)
+
+	playsBefore := songPlays(from)
+	playsAfter := songPlays(to)
+	diff.NewSongs = songsMissingFrom(playsAfter, playsBefore)
+	diff.DroppedSongs = songsMissingFrom(playsBefore, playsAfter)
+	diff.ChangedSongs = changedShares(playsBefore, playsAfter)
+	return diff
+}
+
+// transitionProbabilities works out how likely every transition in a chain is.
+// Chains are keyed by title alone, so the artist of the song played first is
+// taken from known, and otherwise from wherever it shows up as a suffix.
+func transitionProbabilities(chain map[string]Suffixes, known map[string]string) map[Transition]float64 {
+	artists := make(map[string]string)
+	for _, suffixes := range chain {
+		for _, suffix := range suffixes.Suffixes {
+			artists[suffix.Name] = suffix.Artist
+		}
+	}
+	for title, artist := range known {
+		artists[title] = artist
+	}
+	probs := make(map[Transition]float64)
+	for title, suffixes := range chain {
+		total := 0
+		for _, suffix := range suffixes.Suffixes {
+			total += suffix.Frequency
+		}
+		if total == 0 {
+			continue
+		}
+		from := lastFm.BaseSong{Artist: artists[title], Title: title}
+		for _, suffix := range suffixes.Suffixes {
+			t := Transition{From: from, To: lastFm.BaseSong{Artist: suffix.Artist, Title: suffix.Name}}
+			probs[t] += float64(suffix.Frequency) / float64(total)
+		}
+	}
+	return probs
+}
+
+// songPlays counts how many times each song in a chain was played after
+// another song.
+func songPlays(chain map[string]Suffixes) map[lastFm.BaseSong]int {
+	plays := make(map[lastFm.BaseSong]int)
+	for _, suffixes := range chain {
+		for _, suffix := range suffixes.Suffixes {
+			plays[lastFm.BaseSong{Artist: suffix.Artist, Title: suffix.Name}] += suffix.Frequency
+		}
+	}
+	return plays
+}
+
+// songsMissingFrom returns the songs in plays that aren't in other,
+// most played first.
+func songsMissingFrom(plays, other map[lastFm.BaseSong]int) []lastFm.BaseSong {
+	songs := make([]lastFm.BaseSong, 0)
+	for song := range plays {
+		if _, ok := other[song]; !ok {
+			songs = append(songs, song)
+		}
+	}
+	sort.Slice(songs, func(i, j int) bool {
+		a, b := songs[i], songs[j]
+		if plays[a] != plays[b] {
+			return plays[a] > plays[b]
+		}
+		if a.Artist != b.Artist {
+			return a.Artist < b.Artist
+		}
+		return a.Title < b.Title
+	})
+	return songs
+}
+
+// changedShares returns the songs in both before and after whose share of
+// the plays changed, biggest change first.
+func changedShares(before, after map[lastFm.BaseSong]int) []SongChange {
+	total := func(plays map[lastFm.BaseSong]int) float64 {
+		n := 0
+		for _, p := range plays {
+			n += p
+		}
+		return float64(n)
+	}
+	totalBefore, totalAfter := total(before), total(after)
+	changes := make([]SongChange, 0)
+	for song, p := range after {
+		q, ok := before[song]
+		if !ok {
+			continue
+		}
+		shareBefore, shareAfter := float64(q)/totalBefore, float64(p)/totalAfter
+		if shareBefore != shareAfter {
+			changes = append(changes, SongChange{song, shareBefore, shareAfter})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := math.Abs(changes[i].Change()), math.Abs(changes[j].Change())
+		if a != b {
+			return a > b
+		}
+		if changes[i].Artist != changes[j].Artist {
+			return changes[i].Artist < changes[j].Artist
+		}
+		return changes[i].Title < changes[j].Title
+	})
+	return changes
+}
+
+// sortChanges sorts transitions by how much they changed, biggest first.
+func sortChanges(changes []TransitionChange) {
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := math.Abs(changes[i].Change()), math.Abs(changes[j].Change())
+		if a != b {
+			return a > b
+		}
+		if changes[i].From.Title != changes[j].From.Title {
+			return changes[i].From.Title < changes[j].From.Title
+		}
+		return changes[i].To.Title < changes[j].To.Title
+	})
+}
@@ -0,0 +1,102 @@
+package markov
+
+import (
+	"math"
+
+	"github.com/snyderks/spotkov/lastFm"
+	"github.com/snyderks/spotkov/tools"
+)
+
+// feedbackCachePrefix is the Redis key prefix for a user's feedback.
+const feedbackCachePrefix = "feedbackCache."
+
+// Feedback holds the thumbs up and thumbs down a user has given to songs
+// and transitions. Each counts as +1 or -1, and they add up.
+type Feedback struct {
+	Songs       map[lastFm.BaseSong]int
+	Transitions map[Transition]int
+}
+
+// NewFeedback returns feedback with nothing rated yet.
+func NewFeedback() Feedback {
+	return Feedback{
+		Songs:       make(map[lastFm.BaseSong]int),
+		Transitions: make(map[Transition]int),
+	}
+}
+
+// ReadFeedback reads back a user's feedback from the cache.
+// It returns empty feedback along with the error if there isn't any.
+func ReadFeedback(userID string) (Feedback, error) {
+	f := Feedback{}
+	err := lastFm.ReadCache(userID, feedbackCachePrefix, &f)
+	if err != nil {
+		return NewFeedback(), err
+	}
+	// gob leaves out empty maps.
+	if f.Songs == nil {
+		f.Songs = make(map[lastFm.BaseSong]int)
+	}
+	if f.Transitions == nil {
+		f.Transitions = make(map[Transition]int)
+	}
+	return f, nil
+}
+
+// WriteFeedback saves a user's feedback to the cache.
+func WriteFeedback(userID string, f Feedback) error {
+	return lastFm.WriteCache(userID, feedbackCachePrefix, f)
+}
+
+// RateSong adds a thumbs up (true) or thumbs down (false) to a song.
+func (f Feedback) RateSong(song lastFm.BaseSong, up bool) {
+	f.Songs[song] += vote(up)
+}
+
+// RateTransition adds a thumbs up (true) or thumbs down (false) to one
+// song being played after another.
+func (f Feedback) RateTransition(t Transition, up bool) {
+	f.Transitions[t] += vote(up)
+}
+
+// vote turns a thumbs up or down into a number.
+func vote(up bool) int {
+	if up {
+		return 1
+	}
+	return -1
+}
+
+// transitionKey is the canonical form of a Transition.
+type transitionKey struct {
+	From, To tools.SongKey
+}
+
+// Weight turns the feedback into a weight for generating playlists.
+// Every thumbs up on a song or transition multiplies how likely it is by
+// factor, and every thumbs down divides it by factor. Songs are matched
+// by tools.Canonical, like they are in the chain, so feedback on one way
+// of writing a song counts for all of them.
+func (f Feedback) Weight(factor float64) Weight {
+	songs := make(map[tools.SongKey]int, len(f.Songs))
+	for song, votes := range f.Songs {
+		songs[tools.Canonical(song.Artist, song.Title)] += votes
+	}
+	transitions := make(map[transitionKey]int, len(f.Transitions))
+	for t, votes := range f.Transitions {
+		key := transitionKey{
+			From: tools.Canonical(t.From.Artist, t.From.Title),
+			To:   tools.Canonical(t.To.Artist, t.To.Title),
+		}
+		transitions[key] += votes
+	}
+	return func(prev, song lastFm.Song) float64 {
+		to := tools.Canonical(song.Artist, song.Title)
+		from := tools.Canonical(prev.Artist, prev.Title)
+		votes := songs[to] + transitions[transitionKey{From: from, To: to}]
+		if votes == 0 {
+			return 1
+		}
+		return math.Pow(factor, float64(votes))
+	}
+}
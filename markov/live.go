@@ -0,0 +1,98 @@
+package markov
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/snyderks/spotkov/lastFm"
+	"github.com/snyderks/spotkov/tools"
+)
+
+// LiveChain is a chain that can be read by any number of generators while
+// new scrobbles are being added to it.
+//
+// Readers take a snapshot of the chain, which never changes once it's been
+// taken. Writers copy the current version, add to the copy, and then swap
+// it in, so a generator always sees one consistent version of the chain.
+type LiveChain struct {
+	writeMu sync.Mutex   // held while building the next version
+	current atomic.Value // holds the current *FirstOrder
+	last    lastFm.Song  // most recent song added, to link the next batch to
+	hasLast bool
+	canon   *canonicalSongs // how the songs in the chain are written
+}
+
+// NewLiveChain builds a live chain from a listening history.
+func NewLiveChain(songs []lastFm.Song) *LiveChain {
+	lc := &LiveChain{canon: newCanonicalSongs(nil)}
+	chain := buildChain(songs, lc.canon)
+	lc.current.Store(&FirstOrder{chain: chain, titles: lc.canon.titles(chain)})
+	if len(songs) > 0 {
+		lc.last = lc.canon.song(songs[len(songs)-1])
+		lc.hasLast = true
+	}
+	return lc
+}
+
+// Snapshot returns the current version of the chain.
+// The snapshot must not be modified, and won't see any songs added later.
+func (lc *LiveChain) Snapshot() map[string]Suffixes {
+	return lc.Model().chain
+}
+
+// Model returns a model for the current version of the chain, which
+// doesn't change either.
+func (lc *LiveChain) Model() *FirstOrder {
+	return lc.current.Load().(*FirstOrder)
+}
+
+// Add adds songs played after the ones already in the chain, in the order
+// they were played, and makes them visible to new snapshots.
+func (lc *LiveChain) Add(songs []lastFm.Song) {
+	if len(songs) == 0 {
+		return
+	}
+	lc.writeMu.Lock()
+	defer lc.writeMu.Unlock()
+
+	old := lc.Model()
+	chain := make(map[string]Suffixes, len(old.chain)+len(songs))
+	for key, suffixes := range old.chain {
+		chain[key] = suffixes
+	}
+	titles := make(map[string]string, len(old.titles)+len(songs))
+	for title, key := range old.titles {
+		titles[title] = key
+	}
+	// Suffixes are shared with the old version until they're changed.
+	copied := make(map[string]bool)
+	songs = lc.canon.all(songs)
+	if lc.hasLast {
+		addTransition(chain, lc.last, songs[0], copied)
+	}
+	for i := 0; i < len(songs)-1; i++ {
+		addTransition(chain, songs[i], songs[i+1], copied)
+	}
+	for _, song := range append([]lastFm.Song{lc.last}, songs...) {
+		if _, ok := chain[song.Title]; ok {
+			titles[tools.CanonicalTitle(song.Title)] = song.Title
+		}
+	}
+	lc.last = songs[len(songs)-1]
+	lc.hasLast = true
+	lc.current.Store(&FirstOrder{chain: chain, titles: titles})
+}
+
+// Replace swaps in a new listening history, such as after a full rebuild.
+func (lc *LiveChain) Replace(songs []lastFm.Song) {
+	canon := newCanonicalSongs(nil)
+	chain := buildChain(songs, canon)
+	lc.writeMu.Lock()
+	defer lc.writeMu.Unlock()
+	lc.current.Store(&FirstOrder{chain: chain, titles: canon.titles(chain)})
+	lc.canon = canon
+	lc.hasLast = len(songs) > 0
+	if lc.hasLast {
+		lc.last = canon.song(songs[len(songs)-1])
+	}
+}
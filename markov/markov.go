@@ -3,10 +3,13 @@
 package markov
 
 import (
+	"context"
 	"errors"
+	"math"
 	"math/rand"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/snyderks/spotkov/lastFm"
@@ -34,162 +37,342 @@ type CDF [][2]int
 
 const maxAttempts = 200
 
+// weightResolution is how finely weights are applied to frequencies.
+// Weighted frequencies are rounded to whole numbers for the CDF, so they're
+// scaled up first to keep small weights from rounding down to nothing.
+const weightResolution = 1000
+
 // BuildChain determines what songs are played after others and creates a
 // chain to then randomly select from.
-// Takes an array of songs and returns a map.
+// Takes an array of songs, oldest first, and returns a map.
+// Different ways of writing the same song are one song in the chain.
+// See Canonicalize.
 func BuildChain(songs []lastFm.Song) map[string]Suffixes {
+	return buildChain(songs, newCanonicalSongs(nil))
+}
+
+// buildChain is BuildChain, making songs canonical with canon.
+func buildChain(songs []lastFm.Song, canon *canonicalSongs) map[string]Suffixes {
+	songs = canon.all(songs)
 	// A prefix length of 1 is used (for now, it makes it super easy to get subsequent songs)
 	chain := make(map[string]Suffixes, len(songs))
 	// Creating suffixes, so the last song played doesn't have any yet.
-	for i, song := range songs[:len(songs)-1] {
-		// try and get the suffixes
-		suffixes, exists := chain[song.Title]
-		if exists {
-			nextSong := songs[i+1]
-			// don't want to add duplicates
-			if nextSong.Title != song.Title || nextSong.Artist != song.Artist {
-				timeSplit := song.Timestamp.Sub(nextSong.Timestamp)
-				if timeSplit < time.Hour {
-					found := false
-					for i, suffix := range suffixes.Suffixes {
-						if suffix.Name == nextSong.Title {
-							suffixes.Suffixes[i].Frequency++
-							found = true
-							break
-						}
-					}
-					if !found {
-						suffixes.Suffixes = append(suffixes.Suffixes,
-							Suffix{Name: nextSong.Title, Artist: nextSong.Artist, Frequency: 1})
-					}
-					suffixes.Total += 1
-					chain[song.Title] = suffixes
-				}
-			}
-		} else {
-			suffix := Suffix{
-				Name:      songs[i+1].Title,
-				Artist:    songs[i+1].Artist,
-				Frequency: 1,
-			}
-			chain[song.Title] = Suffixes{
-				Suffixes: append(make([]Suffix, 0), suffix),
-			}
-		}
+	for i := 0; i < len(songs)-1; i++ {
+		addTransition(chain, songs[i], songs[i+1], nil)
 	}
 	return chain
 }
 
+// addTransition records that nextSong was played after song in the chain.
+// If copied isn't nil, the suffixes of song are copied before they're
+// changed, unless copied says that's already been done. This lets the chain
+// share suffixes with an older version of itself without changing it.
+//
+// The first song played after song is always recorded, so that every song
+// but the last one played is in the chain. Later ones are only recorded
+// when they're linked, and only those are counted in Total.
+func addTransition(chain map[string]Suffixes, song lastFm.Song, nextSong lastFm.Song, copied map[string]bool) {
+	// try and get the suffixes
+	suffixes, exists := chain[song.Title]
+	if exists && !isLinked(song, nextSong) {
+		return
+	}
+	if copied != nil && !copied[song.Title] {
+		suffixes.Suffixes = append(make([]Suffix, 0, len(suffixes.Suffixes)+1), suffixes.Suffixes...)
+		copied[song.Title] = true
+	}
+	found := false
+	for i, suffix := range suffixes.Suffixes {
+		if suffix.Name == nextSong.Title {
+			suffixes.Suffixes[i].Frequency++
+			found = true
+			break
+		}
+	}
+	if !found {
+		suffixes.Suffixes = append(suffixes.Suffixes,
+			Suffix{Name: nextSong.Title, Artist: nextSong.Artist, Frequency: 1})
+	}
+	if exists {
+		suffixes.Total += 1
+	}
+	chain[song.Title] = suffixes
+}
+
+// isLinked reports whether nextSong counts as following song when they're
+// played one after the other.
+func isLinked(song lastFm.Song, nextSong lastFm.Song) bool {
+	// don't want to add duplicates
+	if nextSong.Title == song.Title && nextSong.Artist == song.Artist {
+		return false
+	}
+	// songs are in the order they were played, so this is how long
+	// after song nextSong was played.
+	timeSplit := nextSong.Timestamp.Sub(song.Timestamp)
+	return timeSplit < time.Hour
+}
+
+// Options controls which songs may be picked when generating from a chain.
+type Options struct {
+	// Constraints that every song after the seed has to satisfy.
+	Constraints Constraints
+	// Weights that scale how likely each suffix is to be picked.
+	Weights Weights
+}
+
 // GenerateSongList takes a seed song, a chain to select from, a length, and the maximum songs by one artist in a row.
 // It returns a list of songs and an optional error.
 func GenerateSongList(length int, maxBySameArtist int, startingSong lastFm.Song, chain map[string]Suffixes) ([]lastFm.Song, error) {
-	foundSuffix := false
+	opts := Options{Constraints: Constraints{NoRepeats(), MaxBySameArtist(maxBySameArtist)}}
+	return GenerateSongListWithOptions(length, startingSong, chain, opts)
+}
+
+// GenerateSongListWithOptions takes a seed song, a chain to select from,
+// a length, and the options to generate with.
+// It returns a list of songs and an optional error.
+func GenerateSongListWithOptions(length int, startingSong lastFm.Song, chain map[string]Suffixes, opts Options) ([]lastFm.Song, error) {
+	return GenerateSongListFromModel(length, startingSong, NewFirstOrder(chain), opts)
+}
+
+// GenerateSongListFromModel takes a seed song, a model to select from,
+// a length, and the options to generate with.
+// It returns a list of songs and an optional error.
+func GenerateSongListFromModel(length int, startingSong lastFm.Song, model Model, opts Options) ([]lastFm.Song, error) {
 	var genError error
 	list := make([]lastFm.Song, 0, length)
 	list = append(list, startingSong)
+	accept := func(list []lastFm.Song, song lastFm.Song) bool {
+		return opts.Constraints.Allow(list, song, length)
+	}
 	// Basic length loop
 	for i := 0; i < length-1; i++ {
-		foundSuffix = false
-		// Start at the end of the list and use that as the prefix.
-		// Try it and if it doesn't work, keep going back to the start.
-		// If we reach the start of the list and it still can't find a suffix,
-		// kill the loop and return what was found.
-		for j := i; j >= 0 && foundSuffix == false; j-- {
-			attempts := 0
-			for attempts < maxAttempts {
-				song, err := selectSuffix(chain, list[j].Title)
-				if err == nil {
-					// do not add the song if it's already in the list.
-					isDupe := false
-					for _, s := range list {
-						// this is considered a match
-						if s.Title == song.Title && s.Artist == song.Artist {
-							isDupe = true
-							break
-						}
-					}
-					// if there are maxBySameArtist songs previously added by the same artist,
-					// don't add this one.
-					isRepeatArtist := false
-					if len(list) > 1 && !isDupe {
-						// start at the end
-						checked := 0
-						repeats := 0
-						for checked < maxBySameArtist {
-							if list[i-checked].Artist == song.Artist {
-								repeats++
-								if repeats >= maxBySameArtist {
-									isRepeatArtist = true
-									break
-								}
-							}
-							checked++
-						}
-					}
-					if !isDupe && !isRepeatArtist {
-						list = append(list, song)
-						foundSuffix = true
-						break
-					} else {
-						attempts++
-					}
-				} else {
-					return list, err
-				}
-			}
+		song, found, err := nextSong(model, list, opts.Weights, accept)
+		if err != nil {
+			return list, err
 		}
-		if !foundSuffix {
+		if !found {
 			genError = errors.New("An error occurred in generating your playlist. Please try again.")
 			break
 		}
+		list = append(list, song)
 	}
 	return list, genError
 }
 
-func selectSuffix(chain map[string]Suffixes, prefix string) (lastFm.Song, error) {
-	exists := false
-	for key := range chain {
-		fmtPrefix := tools.LowerAndStripNonAlphaNumeric(prefix)
-		fmtKey := tools.LowerAndStripNonAlphaNumeric(key)
-		if fmtKey == fmtPrefix || strings.HasPrefix(fmtKey, fmtPrefix) {
-			exists = true
-			// It might be slightly different in the chain. This will allow it to continue if it is.
-			prefix = key
-			break
-		}
+// StreamSongs yields songs from the chain indefinitely, beginning with the
+// seed song. A song isn't repeated until at least window other songs have
+// been yielded since it last appeared, and there are never more than
+// maxBySameArtist songs by one artist in a row.
+// The returned channel is closed when ctx is cancelled or when the chain
+// can't produce another song.
+func StreamSongs(ctx context.Context, window int, maxBySameArtist int, startingSong lastFm.Song, chain map[string]Suffixes) <-chan lastFm.Song {
+	if maxBySameArtist > window {
+		window = maxBySameArtist
 	}
-	song := lastFm.Song{}
-	if exists {
-		if len(chain[prefix].Suffixes) > 1 {
-			suffixes := chain[prefix].Suffixes
-			cdf := make(CDF, 0, len(suffixes)) // cumulative distribution array with index 0 as the value, 1 as the Suffix index
-			for j, suffix := range suffixes {
-				freq := suffix.Frequency
-
-				if freq > 0 {
-					cdf = append(cdf, [2]int{freq, j})
-				}
-			}
+	opts := Options{Constraints: Constraints{NoRepeats(), MaxBySameArtist(maxBySameArtist)}}
+	return StreamSongsWithOptions(ctx, window, startingSong, chain, opts)
+}
 
-			sort.Sort(cdf) // making the CDF is much easier with sorting first.
+// StreamSongsWithOptions yields songs from the chain indefinitely, beginning
+// with the seed song. The constraints in opts only see the last window songs,
+// and treat them as a playlist of that length.
+// The returned channel is closed when ctx is cancelled or when the chain
+// can't produce another song.
+func StreamSongsWithOptions(ctx context.Context, window int, startingSong lastFm.Song, chain map[string]Suffixes, opts Options) <-chan lastFm.Song {
+	return StreamSongsFromModel(ctx, window, startingSong, NewFirstOrder(chain), opts)
+}
+
+// StreamSongsFromModel yields songs from the model indefinitely, beginning
+// with the seed song. The constraints in opts only see the last window songs,
+// and treat them as a playlist of that length.
+// The returned channel is closed when ctx is cancelled or when the model
+// can't produce another song.
+func StreamSongsFromModel(ctx context.Context, window int, startingSong lastFm.Song, model Model, opts Options) <-chan lastFm.Song {
+	songs := make(chan lastFm.Song)
+	if window < 1 {
+		window = 1
+	}
+	accept := func(recent []lastFm.Song, song lastFm.Song) bool {
+		return opts.Constraints.Allow(recent, song, window)
+	}
+	go func() {
+		defer close(songs)
+		recent := make([]lastFm.Song, 0, window)
+		song := startingSong
+		for {
+			select {
+			case songs <- song:
+			case <-ctx.Done():
+				return
+			}
+			if len(recent) == window {
+				// slide the window along without growing the backing array.
+				copy(recent, recent[1:])
+				recent = recent[:window-1]
+			}
+			recent = append(recent, song)
 
-			// Creating the cdf here
-			for j := 1; j < len(cdf); j++ {
-				cdf[j][0] = cdf[j-1][0] + cdf[j][0]
+			next, found, err := nextSong(model, recent, opts.Weights, accept)
+			if err != nil || !found {
+				return
 			}
-			// Now to do the search
+			song = next
+		}
+	}()
+	return songs
+}
+
+// nextSong finds a song to follow list.
+// It starts at the end of the list and uses that as the prefix.
+// If no suffix of that song is accepted, it keeps going back to the start.
+// found is false if no song in the list has an accepted suffix.
+func nextSong(model Model, list []lastFm.Song, weights Weights, accept func([]lastFm.Song, lastFm.Song) bool) (song lastFm.Song, found bool, err error) {
+	for j := len(list) - 1; j >= 0; j-- {
+		cdf, suffixes, err := weightedCDF(model, list[:j+1], weights)
+		if err == errAllWeightedOut {
+			continue
+		} else if err != nil {
+			return lastFm.Song{}, false, err
+		}
+		for attempts := 0; attempts < maxAttempts; attempts++ {
 			suffix := suffixes[searchCDF(cdf)]
-			name := suffix.Name
-			artist := suffix.Artist
-			song = lastFm.Song{Artist: artist, Title: name}
-		} else { // there's only one choice.
-			name := chain[prefix].Suffixes[0].Name
-			artist := chain[prefix].Suffixes[0].Artist
-			song = lastFm.Song{Artist: artist, Title: name}
+			song = lastFm.Song{Artist: suffix.Artist, Title: suffix.Name}
+			if accept(list, song) {
+				return song, true, nil
+			}
+		}
+	}
+	return lastFm.Song{}, false, nil
+}
+
+// isDuplicate reports whether the song is already in the list.
+func isDuplicate(list []lastFm.Song, song lastFm.Song) bool {
+	for _, s := range list {
+		// this is considered a match
+		if s.Title == song.Title && s.Artist == song.Artist {
+			return true
+		}
+	}
+	return false
+}
+
+// isRepeatArtist reports whether adding the song would put more than
+// maxBySameArtist songs by the same artist in a row at the end of the list.
+func isRepeatArtist(list []lastFm.Song, song lastFm.Song, maxBySameArtist int) bool {
+	if maxBySameArtist < 1 {
+		return false
+	}
+	repeats := 0
+	// start at the end
+	for i := len(list) - 1; i >= 0 && i >= len(list)-maxBySameArtist; i-- {
+		if list[i].Artist != song.Artist {
+			return false
+		}
+		repeats++
+	}
+	return repeats >= maxBySameArtist
+}
+
+// Model predicts which songs may follow a listening history.
+type Model interface {
+	// Next returns the songs that may follow the last song in history,
+	// with frequencies weighting how likely each one is.
+	// It returns an error if the model doesn't know the last song.
+	Next(history []lastFm.Song) (Suffixes, error)
+}
+
+// FirstOrder is a Model that only looks at the last song played,
+// using a chain made by BuildChain.
+type FirstOrder struct {
+	chain  map[string]Suffixes
+	titles map[string]string // canonical titles, to find seed songs
+}
+
+// BuildFirstOrder builds a chain from a listening history, oldest first,
+// and returns a FirstOrder model for it. It's the same as using
+// NewFirstOrder with BuildChain, without reading every title again.
+func BuildFirstOrder(songs []lastFm.Song) *FirstOrder {
+	canon := newCanonicalSongs(nil)
+	chain := buildChain(songs, canon)
+	return &FirstOrder{chain: chain, titles: canon.titles(chain)}
+}
+
+// NewFirstOrder returns a FirstOrder model for a chain. Each title in the
+// chain is made canonical, so a model that's used more than once should
+// be kept rather than made again.
+func NewFirstOrder(chain map[string]Suffixes) *FirstOrder {
+	f := &FirstOrder{chain: chain, titles: make(map[string]string, len(chain))}
+	for key := range chain {
+		f.titles[tools.CanonicalTitle(key)] = key
+	}
+	return f
+}
+
+// Next returns the suffixes of the last song in history.
+func (f *FirstOrder) Next(history []lastFm.Song) (Suffixes, error) {
+	prefix := history[len(history)-1].Title
+	if suffixes, exists := f.chain[prefix]; exists {
+		return suffixes, nil
+	}
+	// It might be slightly different in the chain. This will allow it to continue if it is.
+	fmtPrefix := tools.CanonicalTitle(prefix)
+	if key, exists := f.titles[fmtPrefix]; exists {
+		return f.chain[key], nil
+	}
+	for fmtKey, key := range f.titles {
+		if strings.HasPrefix(fmtKey, fmtPrefix) {
+			return f.chain[key], nil
+		}
+	}
+	return Suffixes{}, errSongNotFound
+}
+
+// knowsExactly reports whether the chain has suffixes for song's title.
+func (f *FirstOrder) knowsExactly(song lastFm.BaseSong) bool {
+	_, ok := f.chain[song.Title]
+	return ok
+}
+
+// errSongNotFound is returned when a model doesn't know a song.
+var errSongNotFound = errors.New("The song you entered couldn't be found. Please try again.")
+
+// errAllWeightedOut is returned by weightedCDF when a song has suffixes,
+// but the weights rule every one of them out.
+var errAllWeightedOut = errors.New("Every song that could come next was ruled out.")
+
+// weightedCDF builds a CDF to pick a song to follow the history from the
+// model, weighted by how often each suffix followed it and by any extra
+// weights. The CDF indexes into the suffixes returned with it.
+func weightedCDF(model Model, history []lastFm.Song, weights Weights) (CDF, []Suffix, error) {
+	next, err := model.Next(history)
+	if err != nil {
+		return nil, nil, err
+	}
+	prev := history[len(history)-1]
+	suffixes := next.Suffixes
+	cdf := make(CDF, 0, len(suffixes)) // cumulative distribution array with index 0 as the value, 1 as the Suffix index
+	for j, suffix := range suffixes {
+		freq := suffix.Frequency
+		if len(weights) > 0 {
+			w := weights.Weigh(prev, lastFm.Song{Artist: suffix.Artist, Title: suffix.Name})
+			freq = int(math.Round(float64(freq) * w * weightResolution))
+		}
+
+		if freq > 0 {
+			cdf = append(cdf, [2]int{freq, j})
 		}
-		return song, nil
 	}
-	return lastFm.Song{}, errors.New("The song you entered couldn't be found. Please try again.")
+	if len(cdf) == 0 {
+		return nil, nil, errAllWeightedOut
+	}
+
+	sort.Sort(cdf) // making the CDF is much easier with sorting first.
+
+	// Creating the cdf here
+	for j := 1; j < len(cdf); j++ {
+		cdf[j][0] = cdf[j-1][0] + cdf[j][0]
+	}
+	return cdf, suffixes, nil
 }
 
 // Sort interface implementation
@@ -220,66 +403,48 @@ func (cdf CDF) Swap(i, j int) {
 // The y values can be anything desired. Their value is irrelevant.
 //
 // Behavior:
-// Any number between the current x value and the next one falls to the lower x value.
-// This can also be defined as [Low, High) -> Low.
+// Any number above the previous x value, up to and including the current one,
+// falls to the current x value. This can also be defined as (Low, High] -> High,
+// so each row is picked in proportion to its weight.
 // The domain of the CDF is defined as [1, CDF[-1][0]]. (CDF[-1] is the last element of the array)
 func searchCDF(cdf CDF) int {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	// Doing the -1 and +1 because Intn can return 0, which isn't valid. This shifts everything right one.
 	// Picking a random number in the array
-	num := r.Intn(cdf[len(cdf)-1][0]) + 1
+	num := randomIntn(cdf[len(cdf)-1][0]) + 1
+	return pickCDF(cdf, num)
+}
 
-	// Binary search! Look for the number generated.
-	right := len(cdf) - 1
-	left := 0
-	done := false
-	index := -1
+// random is shared by every generator, so ones running at the same time
+// don't start from the same seed and make the same picks. A rand.Rand
+// isn't safe to use from more than one goroutine, so it's locked.
+var (
+	randomMu sync.Mutex
+	random   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// randomIntn returns a random number in [0, n) from random.
+func randomIntn(n int) int {
+	randomMu.Lock()
+	defer randomMu.Unlock()
+	return random.Intn(n)
+}
 
-	for done == false {
+// pickCDF returns the y value of the row of the CDF that num falls to.
+// See searchCDF.
+func pickCDF(cdf CDF, num int) int {
+	// Binary search! Look for the first x value that's at least the number generated.
+	left := 0
+	right := len(cdf) - 1
+	for left < right {
 		// pick the middle
 		m := (left + right) / 2
-		am := cdf[m][0]
-		// found the correct number. Not index, but number.
-		if am == num {
-			index = m
-			done = true
-		} else if am < num {
+		if cdf[m][0] < num {
 			// need to move to right half
-			if m == len(cdf)-1 {
-				// can't move right, so return current index.
-				index = m
-				done = true
-			} else if cdf[m+1][0] > num {
-				// select current index if
-				// next value is more than desired number.
-				// current index then satisfies
-				// [Low, High).
-				index = m
-				done = true
-			} else {
-				// bring left bound to the right half
-				left = m + 1
-			}
+			left = m + 1
 		} else {
-			// need to move to left half
-			if m == 0 {
-				// can't move left, return current index
-				index = m
-				done = true
-			} else if cdf[m-1][0] <= num {
-				// previous element is less than or equal to desired
-				// number, satisfying [Low, High).
-				// The low is selected.
-				index = m - 1
-				done = true
-			} else {
-				// bring right bound to the left half
-				right = m - 1
-			}
+			// the middle could be it, so keep it in the left half
+			right = m
 		}
 	}
-	if done == false || index < 0 || index > len(cdf)-1 {
-		panic("Something went wrong in the binary search")
-	}
-	return cdf[index][1]
+	return cdf[left][1]
 }
@@ -0,0 +1,666 @@
+package markov
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/snyderks/spotkov/lastFm"
+	"github.com/snyderks/spotkov/tools"
+)
+
+// testHistory is a short listening history that loops back on itself,
+// so every song in it has at least one suffix.
+var testHistory = []lastFm.Song{
+	{Artist: "Muse", Title: "Madness"},
+	{Artist: "Radiohead", Title: "Reckoner"},
+	{Artist: "Muse", Title: "Uprising"},
+	{Artist: "Portishead", Title: "Roads"},
+	{Artist: "Radiohead", Title: "Nude"},
+	{Artist: "Bjork", Title: "Joga"},
+	{Artist: "Muse", Title: "Madness"},
+	{Artist: "Portishead", Title: "Roads"},
+	{Artist: "Bjork", Title: "Hyperballad"},
+	{Artist: "Radiohead", Title: "Reckoner"},
+	{Artist: "Muse", Title: "Madness"},
+}
+
+// TestStreamSongs checks that the stream keeps going past the number of
+// unique songs while honoring the no-repeat window and the artist limit.
+func TestStreamSongs(t *testing.T) {
+	chain := BuildChain(testHistory)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	window := 2
+	list := make([]lastFm.Song, 0)
+	for song := range StreamSongs(ctx, window, 1, testHistory[0], chain) {
+		list = append(list, song)
+		if len(list) == 50 {
+			break
+		}
+	}
+	if len(list) != 50 {
+		t.Fatal("The stream ended early after", len(list), "songs.")
+	}
+	for i := 1; i < len(list); i++ {
+		if list[i].Artist == list[i-1].Artist {
+			t.Error("Songs", i-1, "and", i, "are both by", list[i].Artist)
+		}
+		for j := i - window; j < i; j++ {
+			if j >= 0 && list[j] == list[i] {
+				t.Error("Song", list[i].Title, "was repeated within the window at", i)
+			}
+		}
+	}
+}
+
+// TestStreamSongsCancel checks that the stream is closed once its context
+// has been cancelled.
+func TestStreamSongsCancel(t *testing.T) {
+	chain := BuildChain(testHistory)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	songs := StreamSongs(ctx, 2, 1, testHistory[0], chain)
+	<-songs
+	cancel()
+	// at most one song may already be on its way.
+	for i := 0; i < 2; i++ {
+		if _, ok := <-songs; !ok {
+			return
+		}
+	}
+	t.Error("The stream was still open after cancelling.")
+}
+
+// TestGenerateSongList checks that a bounded list has no duplicates and
+// no songs by the same artist in a row.
+func TestGenerateSongList(t *testing.T) {
+	chain := BuildChain(testHistory)
+	list, err := GenerateSongList(5, 1, testHistory[0], chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 5 {
+		t.Error("Expected 5 songs, got", len(list))
+	}
+	for i := range list {
+		for j := 0; j < i; j++ {
+			if list[i] == list[j] {
+				t.Error("Song", list[i].Title, "appears twice.")
+			}
+		}
+		if i > 0 && list[i].Artist == list[i-1].Artist {
+			t.Error("Songs", i-1, "and", i, "are both by", list[i].Artist)
+		}
+	}
+}
+
+// TestConstraints checks the diversity constraints against small playlists.
+func TestConstraints(t *testing.T) {
+	muse := lastFm.Song{Artist: "Muse", Title: "Uprising"}
+	list := []lastFm.Song{
+		{Artist: "Muse", Title: "Madness"},
+		{Artist: "Radiohead", Title: "Reckoner"},
+	}
+	top := TopSongs(testHistory, 1)
+	if !top[lastFm.BaseSong{Artist: "Muse", Title: "Madness"}] || len(top) != 1 {
+		t.Error("TopSongs returned", top, "instead of only Madness.")
+	}
+
+	cases := []struct {
+		name       string
+		constraint Constraint
+		length     int
+		allowed    bool
+	}{
+		{"gap of 1", MinArtistGap(1), 10, true},
+		{"gap of 2", MinArtistGap(2), 10, false},
+		{"share of a half", MaxArtistShare(0.5), 4, true},
+		{"share of a quarter", MaxArtistShare(0.25), 4, false},
+		{"enough room for 3 artists", MinDistinctArtists(3), 5, true},
+		{"no room for 3 artists", MinDistinctArtists(3), 3, false},
+		{"one top song", MaxFromTopSongs(top, 1), 10, true},
+		{"no top songs", MaxFromTopSongs(top, 0), 10, true},
+		{"no repeats", NoRepeats(), 10, true},
+	}
+	for _, c := range cases {
+		if allowed := c.constraint.Allow(list, muse, c.length); allowed != c.allowed {
+			t.Error(c.name, "returned", allowed, "instead of", c.allowed)
+		}
+	}
+	if MaxFromTopSongs(top, 0).Allow(nil, list[0], 10) {
+		t.Error("A top song was allowed with a limit of 0.")
+	}
+}
+
+// TestGenerateSongListWithOptions checks that a playlist generated with
+// an artist share limit honors it.
+func TestGenerateSongListWithOptions(t *testing.T) {
+	chain := BuildChain(testHistory)
+	opts := Options{Constraints: Constraints{NoRepeats(), MaxArtistShare(0.4)}}
+	list, err := GenerateSongListWithOptions(5, testHistory[0], chain, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for _, song := range list[1:] {
+		counts[song.Artist]++
+	}
+	for artist, count := range counts {
+		if count > 2 {
+			t.Error(artist, "has", count, "songs in a playlist of 5.")
+		}
+	}
+}
+
+// TestSearchCDF checks that rows are picked in proportion to their weights.
+func TestSearchCDF(t *testing.T) {
+	cdf := CDF{{1, 0}, {10, 1}}
+	// Each row gets the numbers above the row before it, up to its own.
+	for num, want := range map[int]int{1: 0, 2: 1, 9: 1, 10: 1} {
+		if got := pickCDF(cdf, num); got != want {
+			t.Error(num, "fell to row", got, "instead of", want)
+		}
+	}
+	picks := make(map[int]int)
+	for i := 0; i < 1000; i++ {
+		picks[searchCDF(cdf)]++
+	}
+	if picks[1] < picks[0]*3 {
+		t.Error("A row with weight 9 wasn't picked much more than one with weight 1:", picks)
+	}
+}
+
+// TestFreshnessWeights checks that recently played songs are weighted
+// down and long forgotten songs are weighted up.
+func TestFreshnessWeights(t *testing.T) {
+	now := time.Now()
+	history := []lastFm.Song{
+		{Artist: "Muse", Title: "Madness", Timestamp: now.AddDate(-1, 0, 0)},
+		{Artist: "Radiohead", Title: "Reckoner", Timestamp: now.Add(-time.Hour)},
+		{Artist: "Muse", Title: "Madness", Timestamp: now.AddDate(0, -8, 0)},
+		{Artist: "Portishead", Title: "Roads", Timestamp: now.AddDate(0, -7, 0)},
+	}
+	lastPlayed := LastPlayed(history)
+	if !lastPlayed[lastFm.BaseSong{Artist: "Muse", Title: "Madness"}].Equal(history[2].Timestamp) {
+		t.Error("LastPlayed didn't keep the latest play of Madness.")
+	}
+
+	weights := Weights{
+		Freshness(lastPlayed, now.Add(-24*time.Hour), 0),
+		Rediscover(lastPlayed, now.AddDate(0, -6, 0), 3),
+	}
+	cases := map[lastFm.Song]float64{
+		history[1]:                       0,
+		history[2]:                       3,
+		{Artist: "Bjork", Title: "Joga"}: 1,
+	}
+	for song, expected := range cases {
+		if w := weights.Weigh(lastFm.Song{}, song); w != expected {
+			t.Error(song.Title, "was weighted", w, "instead of", expected)
+		}
+	}
+
+	// Reckoner was played too recently, so it should never be picked after
+	// Madness.
+	chain := BuildChain(testHistory)
+	for i := 0; i < 50; i++ {
+		cdf, suffixes, err := weightedCDF(NewFirstOrder(chain), testHistory[:1], weights)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if suffixes[searchCDF(cdf)].Name == "Reckoner" {
+			t.Fatal("A song that was weighted out was picked.")
+		}
+	}
+}
+
+// TestGenerateSongLists checks that playlists generated together don't
+// share songs other than the seed when limited to one list per song.
+func TestGenerateSongLists(t *testing.T) {
+	chain := BuildChain(testHistory)
+	opts := Options{Constraints: Constraints{NoRepeats()}}
+	lists, _ := GenerateSongLists(3, 3, 1, testHistory[0], chain, opts)
+	if len(lists) != 3 {
+		t.Fatal("Expected 3 playlists, got", len(lists))
+	}
+	seen := make(map[lastFm.Song]int)
+	for i, list := range lists {
+		if len(list) == 0 || list[0] != testHistory[0] {
+			t.Error("Playlist", i, "doesn't start with the seed.")
+			continue
+		}
+		for _, song := range list[1:] {
+			seen[song]++
+			if seen[song] > 1 {
+				t.Error(song.Title, "is in more than one playlist.")
+			}
+		}
+	}
+}
+
+// TestLiveChainAdd checks that adding songs to a live chain gives the same
+// chain and model as building it from scratch, without changing older
+// snapshots.
+func TestLiveChainAdd(t *testing.T) {
+	split := 5
+	live := NewLiveChain(testHistory[:split])
+	before := live.Snapshot()
+
+	live.Add(testHistory[split:])
+
+	if !reflect.DeepEqual(live.Snapshot(), BuildChain(testHistory)) {
+		t.Error("The live chain doesn't match the chain built from the whole history.")
+	}
+	if !reflect.DeepEqual(before, BuildChain(testHistory[:split])) {
+		t.Error("Adding songs changed an older snapshot.")
+	}
+	if !reflect.DeepEqual(live.Model(), BuildFirstOrder(testHistory)) {
+		t.Error("The live model doesn't match the one built from the whole history.")
+	}
+}
+
+// TestBuildChainFirstTransition checks that the first song played after
+// another is always recorded, even after a gap, and that later ones are
+// only recorded and counted in Total when they're linked.
+func TestBuildChainFirstTransition(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	history := []lastFm.Song{
+		{Artist: "Muse", Title: "Madness", Timestamp: start},
+		{Artist: "Radiohead", Title: "Reckoner", Timestamp: start.Add(2 * time.Hour)},
+		{Artist: "Muse", Title: "Madness", Timestamp: start.Add(4 * time.Hour)},
+		{Artist: "Bjork", Title: "Joga", Timestamp: start.Add(6 * time.Hour)},
+		{Artist: "Muse", Title: "Madness", Timestamp: start.Add(6*time.Hour + 5*time.Minute)},
+		{Artist: "Portishead", Title: "Roads", Timestamp: start.Add(6*time.Hour + 10*time.Minute)},
+	}
+	chain := BuildChain(history)
+	madness := chain["Madness"]
+	if len(madness.Suffixes) != 2 || madness.Suffixes[0].Name != "Reckoner" || madness.Suffixes[1].Name != "Roads" {
+		t.Error("Expected Madness to be followed by Reckoner and Roads, got", madness.Suffixes)
+	}
+	if madness.Total != 1 {
+		t.Error("Expected only Roads to be counted in Madness's total, got", madness.Total)
+	}
+	if _, ok := chain["Reckoner"]; !ok {
+		t.Error("Expected Reckoner to be in the chain even though it was followed by a gap")
+	}
+}
+
+// TestLiveChainConcurrent generates from snapshots of a live chain while
+// songs are being added to it. Run with -race to check for data races.
+func TestLiveChainConcurrent(t *testing.T) {
+	live := NewLiveChain(testHistory)
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				chain := live.Snapshot()
+				for key, suffixes := range chain {
+					// The first transition out of a song isn't counted.
+					total := -1
+					for _, suffix := range suffixes.Suffixes {
+						total += suffix.Frequency
+					}
+					if total != suffixes.Total {
+						t.Error("Snapshot has an inconsistent total for", key)
+						return
+					}
+				}
+				GenerateSongList(4, 1, testHistory[0], chain)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			live.Add(testHistory[i%len(testHistory) : i%len(testHistory)+1])
+		}
+	}()
+	wg.Wait()
+}
+
+// TestPPM checks that a longer context is preferred when it has been seen
+// often enough, and that the model falls back to the last song otherwise.
+func TestPPM(t *testing.T) {
+	a := lastFm.Song{Artist: "Muse", Title: "Madness"}
+	b := lastFm.Song{Artist: "Radiohead", Title: "Reckoner"}
+	c := lastFm.Song{Artist: "Portishead", Title: "Roads"}
+	d := lastFm.Song{Artist: "Bjork", Title: "Joga"}
+	e := lastFm.Song{Artist: "Bjork", Title: "Hyperballad"}
+	history := make([]lastFm.Song, 0)
+	for i := 0; i < 5; i++ {
+		history = append(history, a, b, c, d, b, e)
+	}
+
+	frequencies := func(model *PPM, prefix ...lastFm.Song) map[string]int {
+		next, err := model.Next(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		freqs := make(map[string]int)
+		for _, suffix := range next.Suffixes {
+			freqs[suffix.Name] = suffix.Frequency
+		}
+		return freqs
+	}
+
+	freqs := frequencies(BuildPPM(history, 2, 2), a, b)
+	if freqs["Roads"] <= freqs["Hyperballad"]*4 {
+		t.Error("The longer context wasn't preferred:", freqs)
+	}
+	freqs = frequencies(BuildPPM(history, 2, 100), a, b)
+	if freqs["Roads"] != freqs["Hyperballad"] {
+		t.Error("A rarely seen context was used:", freqs)
+	}
+	// a seed that's written differently should still be found.
+	freqs = frequencies(BuildPPM(history, 2, 2), lastFm.Song{Title: "reckoner"})
+	if len(freqs) != 2 {
+		t.Error("Expected 2 songs to follow Reckoner, got", freqs)
+	}
+	if _, err := BuildPPM(history, 2, 2).Next([]lastFm.Song{{Title: "Unknown"}}); err == nil {
+		t.Error("An unknown song didn't return an error.")
+	}
+
+	list, err := GenerateSongListFromModel(4, a, BuildPPM(history, 3, 2), Options{Constraints: Constraints{NoRepeats()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 4 {
+		t.Error("Expected 4 songs from the model, got", len(list))
+	}
+}
+
+// TestDiffChains checks that new, dropped, and changed transitions and songs
+// are all found.
+func TestDiffChains(t *testing.T) {
+	a := lastFm.Song{Artist: "Muse", Title: "Madness"}
+	b := lastFm.Song{Artist: "Radiohead", Title: "Reckoner"}
+	c := lastFm.Song{Artist: "Portishead", Title: "Roads"}
+	d := lastFm.Song{Artist: "Bjork", Title: "Joga"}
+	before := BuildChain([]lastFm.Song{a, b, a, c})
+	after := BuildChain([]lastFm.Song{a, b, a, b, a, d})
+
+	diff := DiffChains(before, after)
+	if len(diff.NewSongs) != 1 || diff.NewSongs[0].Title != "Joga" {
+		t.Error("Expected Joga to be the only new song, got", diff.NewSongs)
+	}
+	if len(diff.DroppedSongs) != 1 || diff.DroppedSongs[0].Title != "Roads" {
+		t.Error("Expected Roads to be the only dropped song, got", diff.DroppedSongs)
+	}
+	if len(diff.NewTransitions) != 1 || diff.NewTransitions[0].To.Title != "Joga" {
+		t.Error("Expected Madness -> Joga to be new, got", diff.NewTransitions)
+	}
+	if len(diff.DroppedTransitions) != 1 || diff.DroppedTransitions[0].To.Title != "Roads" {
+		t.Error("Expected Madness -> Roads to be dropped, got", diff.DroppedTransitions)
+	}
+	if len(diff.ChangedTransitions) != 1 {
+		t.Fatal("Expected Madness -> Reckoner to change, got", diff.ChangedTransitions)
+	}
+	changed := diff.ChangedTransitions[0]
+	if changed.From != (lastFm.BaseSong{Artist: "Muse", Title: "Madness"}) || changed.Before != 0.5 || changed.After != 2.0/3 {
+		t.Error("Madness -> Reckoner changed wrong:", changed)
+	}
+}
+
+// TestDiffHistories checks that songs only ever played first still have
+// their artist, and that songs whose share of the plays moved are found.
+func TestDiffHistories(t *testing.T) {
+	alison := lastFm.Song{Artist: "Slowdive", Title: "Alison"}
+	a := lastFm.Song{Artist: "Muse", Title: "Madness"}
+	b := lastFm.Song{Artist: "Radiohead", Title: "Reckoner"}
+	c := lastFm.Song{Artist: "Portishead", Title: "Roads"}
+
+	diff := DiffHistories([]lastFm.Song{alison, a, b, c}, []lastFm.Song{a, b, a, b, c})
+	if len(diff.DroppedTransitions) != 1 || diff.DroppedTransitions[0].From != (lastFm.BaseSong{Artist: "Slowdive", Title: "Alison"}) {
+		t.Error("Expected Alison by Slowdive -> Madness to be dropped, got", diff.DroppedTransitions)
+	}
+	// Reckoner went from a third of the plays to half of them.
+	if len(diff.ChangedSongs) == 0 || diff.ChangedSongs[0].Title != "Reckoner" ||
+		diff.ChangedSongs[0].Before != 1.0/3 || diff.ChangedSongs[0].After != 0.5 {
+		t.Error("Expected Reckoner's share to change the most, got", diff.ChangedSongs)
+	}
+}
+
+// TestFeedbackWeight checks that thumbs up and down on songs and transitions
+// multiply together, and count for every way of writing a song.
+func TestFeedbackWeight(t *testing.T) {
+	madness := lastFm.Song{Artist: "Muse", Title: "Madness"}
+	roads := lastFm.Song{Artist: "Portishead", Title: "Roads"}
+	joga := lastFm.Song{Artist: "Bjork", Title: "Joga"}
+	transition := Transition{
+		From: lastFm.BaseSong{Artist: "Muse", Title: "Madness"},
+		To:   lastFm.BaseSong{Artist: "Portishead", Title: "Roads"},
+	}
+
+	f := NewFeedback()
+	f.RateTransition(transition, false)
+	f.RateTransition(transition, false)
+	f.RateSong(transition.To, true)
+	w := f.Weight(2)
+
+	if weight := w(madness, roads); weight != 0.5 {
+		t.Error("Expected a weight of 0.5 after two thumbs down and one up, got", weight)
+	}
+	if weight := w(joga, roads); weight != 2 {
+		t.Error("Expected a weight of 2 after one thumbs up, got", weight)
+	}
+	if weight := w(roads, joga); weight != 1 {
+		t.Error("Expected an unrated song to be left alone, got", weight)
+	}
+
+	// Feedback counts for every way of writing a song.
+	f.RateSong(lastFm.BaseSong{Artist: "Björk feat. Someone", Title: "Jóga - Remastered 2011"}, false)
+	if weight := f.Weight(2)(madness, lastFm.Song{Artist: "bjork", Title: "JOGA"}); weight != 0.5 {
+		t.Error("Expected a weight of 0.5 for another way of writing Joga, got", weight)
+	}
+	if weight := f.Weight(2)(lastFm.Song{Artist: "Muse", Title: "Madness (Live)"}, roads); weight != 0.5 {
+		t.Error("Expected a transition to count from another way of writing Madness, got", weight)
+	}
+}
+
+// TestLoved checks that loved songs are boosted and that LovedOnly keeps
+// everything else out of the playlist.
+func TestLoved(t *testing.T) {
+	lovedTracks := []lastFm.Song{
+		{Artist: "Radiohead", Title: "Nude", Loved: true},
+		{Artist: "Bjork", Title: "Joga", Loved: true},
+		{Artist: "Muse", Title: "Madness"},
+	}
+	loved := LovedSongs(lovedTracks)
+	if len(loved) != 2 || !loved[lastFm.BaseSong{Artist: "Bjork", Title: "Joga"}] {
+		t.Fatal("LovedSongs should only have Nude and Joga, got", loved)
+	}
+	weight := Loved(loved, 3)
+	if w := weight(lastFm.Song{}, lovedTracks[0]); w != 3 {
+		t.Error("Nude was weighted", w, "instead of 3")
+	}
+	if w := weight(lastFm.Song{}, lovedTracks[2]); w != 1 {
+		t.Error("Madness was weighted", w, "instead of 1")
+	}
+
+	// Roads leads to Nude, which leads to Joga, which only leads to Madness.
+	chain := BuildChain(testHistory)
+	opts := Options{Constraints: Constraints{NoRepeats(), LovedOnly(loved)}}
+	list, err := GenerateSongListWithOptions(3, testHistory[3], chain, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[1].Title != "Nude" || list[2].Title != "Joga" {
+		t.Error("Expected Roads, Nude and Joga, got", list)
+	}
+	if _, err = GenerateSongListWithOptions(4, testHistory[3], chain, opts); err == nil {
+		t.Error("Expected an error when there aren't enough reachable loved songs")
+	}
+}
+
+// TestTagConstraints checks that songs are kept in or left out by tag.
+func TestTagConstraints(t *testing.T) {
+	tags := lastFm.Tags{
+		{Artist: "Muse", Title: "Madness"}:       {"alternative rock"},
+		{Artist: "Radiohead", Title: "Reckoner"}: {"alternative rock", "christmas"},
+		{Artist: "Bjork", Title: "Joga"}:         {"electronic"},
+	}
+	tagged := Tagged(tags, "Electronic", "alternative rock")
+	notTagged := NotTagged(tags, "christmas")
+	cases := []struct {
+		song              lastFm.Song
+		tagged, notTagged bool
+	}{
+		{testHistory[0], true, true},
+		{testHistory[1], true, false},
+		{testHistory[5], true, true},
+		{testHistory[3], false, true},
+	}
+	for _, c := range cases {
+		if got := tagged.Allow(nil, c.song, 10); got != c.tagged {
+			t.Error("Tagged allowed", c.song.Title, "was", got)
+		}
+		if got := notTagged.Allow(nil, c.song, 10); got != c.notTagged {
+			t.Error("NotTagged allowed", c.song.Title, "was", got)
+		}
+	}
+}
+
+// TestBridge checks that songs that weren't played are told apart from ones
+// with nothing after them, and that the bridge is the first candidate that
+// was played and is known, written the way it was played.
+func TestBridge(t *testing.T) {
+	model := NewFirstOrder(BuildChain(testHistory))
+	alison := lastFm.Song{Artist: "Slowdive", Title: "Alison"}
+	if Knows(model, alison) || Played(testHistory, alison) {
+		t.Error("A song that was never played shouldn't be known or played")
+	}
+	if !Knows(model, testHistory[4]) {
+		t.Error("The model should know", testHistory[4].Title)
+	}
+	// The last song played has nothing after it.
+	history := append(testHistory[:len(testHistory):len(testHistory)], alison)
+	last := lastFm.Song{Artist: "Slowdive", Title: "ALISON"}
+	if Knows(NewFirstOrder(BuildChain(history)), last) || !Played(history, last) {
+		t.Error("Expected the last song to have been played, but not known")
+	}
+
+	// N is the start of Nude, but was never played.
+	similar := []lastFm.BaseSong{{Artist: "Slowdive", Title: "Alison"}, {Artist: "Nobody", Title: "N"}, {Artist: "radiohead", Title: "NUDE"}}
+	bridge, ok := Bridge(model, testHistory, BridgeCandidates(testHistory, similar, nil))
+	if !ok || bridge != testHistory[4] {
+		t.Error("Expected Nude by Radiohead as the bridge, got", bridge)
+	}
+	if _, ok = Bridge(NewFirstOrder(BuildChain(history)), history, []lastFm.Song{last}); ok {
+		t.Error("Expected a song with nothing after it not to be a bridge")
+	}
+
+	// Madness is Muse's most played song.
+	candidates := BridgeCandidates(testHistory, nil, []string{"Slowdive", "Muse"})
+	if len(candidates) != 2 || candidates[0].Title != "Madness" || candidates[1].Title != "Uprising" {
+		t.Fatal("Expected Madness then Uprising, got", candidates)
+	}
+	if _, ok = Bridge(model, testHistory, BridgeCandidates(testHistory, nil, []string{"Slowdive"})); ok {
+		t.Error("Expected no bridge when nothing similar was played")
+	}
+}
+
+// TestCanonicalChain checks that different ways of writing a song are one
+// node in the chain, and that artist aliases make them one song too.
+func TestCanonicalChain(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	history := []lastFm.Song{
+		{Artist: "Muse", Title: "Madness", Timestamp: start},
+		{Artist: "Radiohead", Title: "Reckoner", Timestamp: start.Add(5 * time.Minute)},
+		{Artist: "Muse", Title: "Madness - Live at Rome Olympic Stadium", Timestamp: start.Add(10 * time.Minute)},
+		{Artist: "Radiohead", Title: "Reckoner (2011 Remaster)", Timestamp: start.Add(15 * time.Minute)},
+		{Artist: "Muse feat. Someone", Title: "MADNESS", Timestamp: start.Add(20 * time.Minute)},
+	}
+	chain := BuildChain(history)
+	if len(chain) != 2 {
+		t.Fatal("Expected one node for each song, got", chain)
+	}
+	madness := chain["Madness"]
+	if len(madness.Suffixes) != 1 || madness.Suffixes[0].Name != "Reckoner" || madness.Suffixes[0].Frequency != 2 {
+		t.Error("Expected Madness to be followed by Reckoner twice, got", madness)
+	}
+	if !Knows(BuildFirstOrder(history), lastFm.Song{Title: "Madness - Remastered"}) {
+		t.Error("Expected another version of Madness to be found in the chain")
+	}
+	songs := Canonicalize(history, nil)
+	if songs[4].Artist != "Muse" || songs[4].Title != "Madness" || !songs[4].Timestamp.Equal(history[4].Timestamp) {
+		t.Error("Expected the last song to be Madness by Muse, got", songs[4])
+	}
+	if !Knows(NewFirstOrder(chain), lastFm.Song{Title: "Reck"}) {
+		t.Error("Expected the start of a title to find Reckoner in the chain")
+	}
+
+	history[3].Artist = "Radiohed"
+	songs = Canonicalize(history, tools.ArtistAliases{"radiohed": "radiohead"})
+	if songs[3].Artist != "Radiohead" || songs[3].Title != "Reckoner" {
+		t.Error("Expected the artist alias to make the fourth song Reckoner by Radiohead, got", songs[3])
+	}
+}
+
+// TestAliases checks that song and artist aliases make variants the same
+// song, and that suggestions point from the variant played less.
+func TestAliases(t *testing.T) {
+	aliases := NewAliases()
+	aliases.AddSong(lastFm.BaseSong{Artist: "Muse", Title: "Madnes"}, lastFm.BaseSong{Artist: "Muse", Title: "Madness"})
+	aliases.AddArtist("Björk Gudmundsdóttir", "Bjork")
+	songs := Canonicalize(aliases.Apply([]lastFm.Song{
+		{Artist: "Bjork", Title: "Hyperballad"},
+		{Artist: "muse", Title: "MADNES"},
+		{Artist: "Bjork Gudmundsdottir", Title: "Joga"},
+		{Artist: "Radiohead", Title: "Nude"},
+	}), aliases.Artists)
+	if songs[1].Title != "Madness" || songs[2].Artist != "Bjork" || songs[3].Title != "Nude" {
+		t.Error("Aliases were applied wrong:", songs)
+	}
+	if !aliases.RemoveArtist("bjork gudmundsdottir") || aliases.RemoveArtist("Bjork Gudmundsdottir") {
+		t.Error("Expected the artist alias to be removed once")
+	}
+
+	aliases.AddArtist("Prince & The Revolution", "Prince and the Revolution")
+	aliases.AddArtist("Prince and the Revolution", "Prince")
+	if aliases.Artists.Artist("Prince & The Revolution") != tools.CanonicalArtist("Prince") {
+		t.Error("Expected an alias to an alias to go all the way to Prince, got", aliases.Artists)
+	}
+	aliases.AddArtist("Prince", "Prince & The Revolution")
+	if aliases.Artists.Artist("Prince") != tools.CanonicalArtist("Prince & The Revolution") || aliases.Artists.Artist("Prince & The Revolution") != tools.CanonicalArtist("Prince & The Revolution") {
+		t.Error("Expected turning an alias around to leave no loop, got", aliases.Artists)
+	}
+	aliases.RemoveArtist("Prince")
+	aliases.RemoveArtist("Prince and the Revolution")
+	aliases.AddSong(lastFm.BaseSong{Artist: "Muse", Title: "Madnness"}, lastFm.BaseSong{Artist: "Muse", Title: "Madnes"})
+	if songs := aliases.Apply([]lastFm.Song{{Artist: "Muse", Title: "Madnness"}}); songs[0].Title != "Madness" {
+		t.Error("Expected an alias to a song alias to go all the way to Madness, got", songs)
+	}
+	aliases.RemoveSong(lastFm.BaseSong{Artist: "Muse", Title: "Madnness"})
+
+	history := []lastFm.Song{
+		{Artist: "Muse", Title: "Madnes"},
+		{Artist: "Muse", Title: "Madness"},
+		{Artist: "Muse", Title: "Madness"},
+		{Artist: "Muse", Title: "Uprising"},
+		{Artist: "Radiohed", Title: "Nude"},
+		{Artist: "Radiohead", Title: "Reckoner"},
+		{Artist: "Radiohead", Title: "Nude"},
+		{Artist: "Portishead", Title: "Roads"},
+		{Artist: "Portishead", Title: "Roads Again"},
+	}
+	suggestions := aliases.SuggestAliases(history, 0.85)
+	if len(suggestions) != 1 {
+		t.Fatal("Expected only Radiohed and Radiohead to be suggested, got", suggestions)
+	}
+	s := suggestions[0]
+	if s.From.Title != "" || s.From.Artist != "Radiohed" || s.To.Artist != "Radiohead" {
+		t.Error("Expected Radiohed -> Radiohead, got", s)
+	}
+	aliases.RemoveSong(lastFm.BaseSong{Artist: "Muse", Title: "Madnes"})
+	suggestions = aliases.SuggestAliases(history, 0.85)
+	if len(suggestions) != 2 || suggestions[1].From.Title != "Madnes" || suggestions[1].To.Title != "Madness" {
+		t.Error("Expected Madnes -> Madness to be suggested once its alias was removed, got", suggestions)
+	}
+}
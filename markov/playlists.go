@@ -0,0 +1,71 @@
+package markov
+
+import (
+	"sync"
+
+	"github.com/snyderks/spotkov/lastFm"
+)
+
+// GenerateSongLists generates count playlists from the same chain at once.
+// See GenerateSongListsFromModel.
+func GenerateSongLists(count int, length int, maxLists int, startingSong lastFm.Song, chain map[string]Suffixes, opts Options) ([][]lastFm.Song, error) {
+	return GenerateSongListsFromModel(count, length, maxLists, startingSong, NewFirstOrder(chain), opts)
+}
+
+// GenerateSongListsFromModel generates count playlists from the same model at once.
+// maxLists is the most playlists any one song may appear in: 1 keeps the
+// playlists from sharing any songs, and 0 doesn't limit it at all.
+// The seed song starts every playlist and doesn't count towards the limit.
+// It returns the playlists in no particular order and the first error
+// encountered, if any. Playlists are returned even if an error occurred.
+func GenerateSongListsFromModel(count int, length int, maxLists int, startingSong lastFm.Song, model Model, opts Options) ([][]lastFm.Song, error) {
+	claims := &songClaims{lists: make(map[lastFm.BaseSong]int), max: maxLists}
+	lists := make([][]lastFm.Song, count)
+	errs := make([]error, count)
+
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		listOpts := opts
+		if maxLists > 0 {
+			// Claiming has to come last so that a song is only claimed
+			// when every other constraint has allowed it.
+			listOpts.Constraints = append(append(Constraints{}, opts.Constraints...), claims.constraint())
+		}
+		wg.Add(1)
+		go func(i int, listOpts Options) {
+			defer wg.Done()
+			lists[i], errs[i] = GenerateSongListFromModel(length, startingSong, model, listOpts)
+		}(i, listOpts)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return lists, err
+		}
+	}
+	return lists, nil
+}
+
+// songClaims keeps track of how many playlists each song has been added to.
+// It is safe for use with goroutines with the embedded mutex.
+type songClaims struct {
+	sync.Mutex
+	lists map[lastFm.BaseSong]int
+	max   int
+}
+
+// constraint returns a Constraint that allows a song if it hasn't been
+// claimed by too many playlists yet, and claims it for the playlist if so.
+func (c *songClaims) constraint() Constraint {
+	return ConstraintFunc(func(list []lastFm.Song, song lastFm.Song, length int) bool {
+		s := lastFm.BaseSong{Artist: song.Artist, Title: song.Title}
+		c.Lock()
+		defer c.Unlock()
+		if c.lists[s] >= c.max {
+			return false
+		}
+		c.lists[s]++
+		return true
+	})
+}
@@ -0,0 +1,170 @@
+package markov
+
+import (
+	"math"
+	"strings"
+
+	"github.com/snyderks/spotkov/lastFm"
+	"github.com/snyderks/spotkov/tools"
+)
+
+// ppmResolution is what PPM probabilities are scaled by to turn them into
+// the whole number frequencies that Suffixes use.
+const ppmResolution = 10000
+
+// PPM is a variable-order Model that uses prediction by partial matching.
+//
+// Instead of only looking at the last song played, it looks at the last few
+// songs, using the longest run of songs that it's seen often enough. Songs
+// that followed longer contexts get most of the probability, and the rest
+// escapes to shorter contexts. Escape probabilities use PPM method C: a
+// context that's been followed by d different songs in n transitions escapes
+// with probability d/(n+d). Songs already predicted by a longer context are
+// excluded when shorter contexts are used.
+//
+// The escape probability left at the shortest context is dropped, so only
+// songs that have followed the last song are ever picked, the same as with
+// a first-order chain.
+type PPM struct {
+	maxOrder int
+	minCount int
+	contexts map[string]*ppmContext
+	titles   map[string]lastFm.BaseSong // formatted titles, to find seed songs
+}
+
+// ppmContext counts the songs that followed one run of songs.
+type ppmContext struct {
+	counts map[lastFm.BaseSong]int
+	total  int
+}
+
+// BuildPPM builds a model that uses up to maxOrder previous songs from a
+// listening history. Contexts longer than one song are only used once
+// they've been seen at least minCount times.
+func BuildPPM(songs []lastFm.Song, maxOrder int, minCount int) *PPM {
+	if maxOrder < 1 {
+		maxOrder = 1
+	}
+	p := &PPM{
+		maxOrder: maxOrder,
+		minCount: minCount,
+		contexts: make(map[string]*ppmContext),
+		titles:   make(map[string]lastFm.BaseSong),
+	}
+	// Contexts are broken up wherever the first-order chain wouldn't link
+	// two songs together.
+	run := make([]lastFm.BaseSong, 0, maxOrder)
+	songs = Canonicalize(songs, nil)
+	for i, song := range songs {
+		s := lastFm.BaseSong{Artist: song.Artist, Title: song.Title}
+		p.titles[tools.CanonicalTitle(s.Title)] = s
+		if i > 0 && !isLinked(songs[i-1], song) {
+			if songs[i-1].Title == song.Title && songs[i-1].Artist == song.Artist {
+				// a repeat isn't a transition, but doesn't end the run either.
+				continue
+			}
+			run = run[:0]
+		}
+		for order := 1; order <= len(run); order++ {
+			key := contextKey(run[len(run)-order:])
+			ctx := p.contexts[key]
+			if ctx == nil {
+				ctx = &ppmContext{counts: make(map[lastFm.BaseSong]int)}
+				p.contexts[key] = ctx
+			}
+			ctx.counts[s]++
+			ctx.total++
+		}
+		if len(run) == maxOrder {
+			copy(run, run[1:])
+			run = run[:maxOrder-1]
+		}
+		run = append(run, s)
+	}
+	return p
+}
+
+// Next blends the songs that followed each context at the end of history,
+// from the longest usable context down to the last song alone.
+func (p *PPM) Next(history []lastFm.Song) (Suffixes, error) {
+	run := make([]lastFm.BaseSong, 0, p.maxOrder)
+	for i := len(history) - 1; i >= 0 && len(run) < p.maxOrder; i-- {
+		run = append([]lastFm.BaseSong{{Artist: history[i].Artist, Title: history[i].Title}}, run...)
+	}
+	// The last song might be written a bit differently than in the history.
+	last := run[len(run)-1]
+	if p.contexts[contextKey(run[len(run)-1:])] == nil {
+		s, ok := p.findTitle(last.Title)
+		if !ok {
+			return Suffixes{}, errSongNotFound
+		}
+		run[len(run)-1] = s
+	}
+
+	probs := make(map[lastFm.BaseSong]float64)
+	escape := 1.0
+	for order := len(run); order >= 1; order-- {
+		ctx := p.contexts[contextKey(run[len(run)-order:])]
+		if ctx == nil || (order > 1 && ctx.total < p.minCount) {
+			continue
+		}
+		n, d := 0, 0
+		for s, count := range ctx.counts {
+			if _, excluded := probs[s]; !excluded {
+				n += count
+				d++
+			}
+		}
+		if d == 0 {
+			continue
+		}
+		for s, count := range ctx.counts {
+			if _, excluded := probs[s]; !excluded {
+				probs[s] = escape * float64(count) / float64(n+d)
+			}
+		}
+		escape *= float64(d) / float64(n+d)
+	}
+	if len(probs) == 0 {
+		return Suffixes{}, errSongNotFound
+	}
+
+	suffixes := Suffixes{Suffixes: make([]Suffix, 0, len(probs))}
+	for s, prob := range probs {
+		freq := int(math.Round(prob * ppmResolution))
+		if freq < 1 {
+			freq = 1
+		}
+		suffixes.Suffixes = append(suffixes.Suffixes, Suffix{Name: s.Title, Artist: s.Artist, Frequency: freq})
+		suffixes.Total += freq
+	}
+	return suffixes, nil
+}
+
+// knowsExactly reports whether any songs followed song on its own.
+func (p *PPM) knowsExactly(song lastFm.BaseSong) bool {
+	return p.contexts[contextKey([]lastFm.BaseSong{song})] != nil
+}
+
+// findTitle looks for a song in the model with a title like title.
+func (p *PPM) findTitle(title string) (lastFm.BaseSong, bool) {
+	fmtTitle := tools.CanonicalTitle(title)
+	if s, ok := p.titles[fmtTitle]; ok {
+		return s, true
+	}
+	for key, s := range p.titles {
+		if strings.HasPrefix(key, fmtTitle) {
+			return s, true
+		}
+	}
+	return lastFm.BaseSong{}, false
+}
+
+// contextKey turns a run of songs into a key for the contexts map.
+func contextKey(run []lastFm.BaseSong) string {
+	parts := make([]string, 0, len(run)*2)
+	for _, s := range run {
+		parts = append(parts, s.Artist, s.Title)
+	}
+	return strings.Join(parts, "\x00")
+}
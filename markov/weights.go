@@ -0,0 +1,89 @@
+package markov
+
+import (
+	"time"
+
+	"github.com/snyderks/spotkov/lastFm"
+)
+
+// Weight scales how likely song is to be picked to follow prev.
+// A weight of 1 leaves the chain's frequencies as they are, and a weight
+// of 0 rules the song out.
+type Weight func(prev, song lastFm.Song) float64
+
+// Weights is a set of weights that are multiplied together.
+type Weights []Weight
+
+// Weigh returns the product of every weight in the set.
+func (ws Weights) Weigh(prev, song lastFm.Song) float64 {
+	product := 1.0
+	for _, w := range ws {
+		product *= w(prev, song)
+		if product == 0 {
+			break
+		}
+	}
+	return product
+}
+
+// LastPlayed returns when each song in a listening history was last played.
+// Songs without a timestamp are left out.
+func LastPlayed(songs []lastFm.Song) map[lastFm.BaseSong]time.Time {
+	played := make(map[lastFm.BaseSong]time.Time)
+	for _, song := range songs {
+		if song.Timestamp.IsZero() {
+			continue
+		}
+		s := lastFm.BaseSong{Artist: song.Artist, Title: song.Title}
+		if song.Timestamp.After(played[s]) {
+			played[s] = song.Timestamp
+		}
+	}
+	return played
+}
+
+// Freshness scales songs that were played after since by factor.
+// A factor of 0 leaves recently played songs out altogether.
+func Freshness(lastPlayed map[lastFm.BaseSong]time.Time, since time.Time, factor float64) Weight {
+	return func(prev, song lastFm.Song) float64 {
+		if lastPlayed[lastFm.BaseSong{Artist: song.Artist, Title: song.Title}].After(since) {
+			return factor
+		}
+		return 1
+	}
+}
+
+// Rediscover scales songs that haven't been played since before by boost,
+// favoring songs that haven't come up in a while.
+func Rediscover(lastPlayed map[lastFm.BaseSong]time.Time, before time.Time, boost float64) Weight {
+	return func(prev, song lastFm.Song) float64 {
+		played, ok := lastPlayed[lastFm.BaseSong{Artist: song.Artist, Title: song.Title}]
+		if ok && played.Before(before) {
+			return boost
+		}
+		return 1
+	}
+}
+
+// LovedSongs returns the songs marked as loved, from the user's loved
+// tracks or a listening history that says which songs are loved.
+func LovedSongs(songs []lastFm.Song) map[lastFm.BaseSong]bool {
+	loved := make(map[lastFm.BaseSong]bool)
+	for _, song := range songs {
+		if song.Loved {
+			loved[lastFm.BaseSong{Artist: song.Artist, Title: song.Title}] = true
+		}
+	}
+	return loved
+}
+
+// Loved scales loved songs by boost, making transitions into them more
+// likely. LovedSongs can be used to build the set.
+func Loved(loved map[lastFm.BaseSong]bool, boost float64) Weight {
+	return func(prev, song lastFm.Song) float64 {
+		if loved[lastFm.BaseSong{Artist: song.Artist, Title: song.Title}] {
+			return boost
+		}
+		return 1
+	}
+}
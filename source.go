@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/snyderks/spotkov/configRead"
+	"github.com/snyderks/spotkov/lastFm"
+	"github.com/snyderks/spotkov/listenBrainz"
+	"github.com/snyderks/spotkov/spotifyHistory"
+)
+
+// sourceFlags are the flags that pick where listening history is read from.
+type sourceFlags struct {
+	source          string
+	listenBrainz    string
+	spotifyHistory  string
+	minPlayed       time.Duration
+	skipsAsFeedback bool
+}
+
+// addSourceFlags adds the flags for picking a history source to a flag set.
+func addSourceFlags(flags *flag.FlagSet) *sourceFlags {
+	sf := &sourceFlags{}
+	flags.StringVar(&sf.source, "source", "", "Where to read your history from: 'lastfm' or 'listenbrainz'. Defaults to the history-source in your config, or Last.FM")
+	flags.StringVar(&sf.listenBrainz, "listenBrainz", "", "Your ListenBrainz user name, if it's different from your Last.FM one. Implies -source=listenbrainz")
+	flags.StringVar(&sf.spotifyHistory, "spotifyHistory", "", "Read your history from Spotify's extended streaming history files matching this pattern instead of Last.FM, like 'MyData/Streaming_History_Audio_*.json'")
+	flags.DurationVar(&sf.minPlayed, "minPlayed", 30*time.Second, "How long a song from -spotifyHistory has to have played for to count")
+	flags.BoolVar(&sf.skipsAsFeedback, "skipsAsFeedback", false, "Treat songs skipped in -spotifyHistory as a thumbs down, on the transition to them if they played for -minPlayed")
+	return sf
+}
+
+// historySource returns where listening history is read from.
+func (sf *sourceFlags) historySource() (lastFm.HistorySource, error) {
+	if sf.spotifyHistory != "" {
+		paths, err := filepath.Glob(sf.spotifyHistory)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			return nil, errors.New("No streaming history files match " + sf.spotifyHistory)
+		}
+		return &spotifyHistory.Source{Paths: paths, MinPlayed: sf.minPlayed}, nil
+	}
+
+	config, _ := configRead.Read("config.json")
+	source := sf.source
+	if source == "" && sf.listenBrainz != "" {
+		source = "listenbrainz"
+	}
+	if source == "" {
+		source = config.HistorySource
+	}
+	switch strings.ToLower(source) {
+	case "", "lastfm":
+		return lastFm.LastFMSource{Options: lastFm.FetchOptions{Progress: printProgress("pages of scrobbles")}}, nil
+	case "listenbrainz":
+		client := listenBrainz.NewClient(config.ListenBrainzToken)
+		return listenBrainz.Source{Client: client, User: sf.listenBrainz}, nil
+	}
+	return nil, errors.New("Unknown history source " + source + ", use 'lastfm' or 'listenbrainz'")
+}
+
+// printProgress returns a progress callback that shows how many of what
+// have been fetched, overwriting the line each time.
+func printProgress(what string) func(done, total int) {
+	return func(done, total int) {
+		if total < 2 {
+			return
+		}
+		fmt.Printf("\rFetched %d of %d %s", done, total, what)
+		if done == total {
+			fmt.Println()
+		}
+	}
+}
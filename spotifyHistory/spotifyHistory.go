@@ -0,0 +1,187 @@
+// Package spotifyHistory reads the extended streaming history that Spotify
+// includes in a download of your account data, so it can be used in place
+// of a Last.FM history.
+package spotifyHistory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/snyderks/spotkov/lastFm"
+	"github.com/snyderks/spotkov/markov"
+)
+
+// entry is one play as it's written in a streaming history file.
+// Podcast episodes have no track, artist, or album, so those can be null.
+type entry struct {
+	Timestamp   string  `json:"ts"`
+	MsPlayed    int     `json:"ms_played"`
+	Title       *string `json:"master_metadata_track_name"`
+	Artist      *string `json:"master_metadata_album_artist_name"`
+	Album       *string `json:"master_metadata_album_album_name"`
+	URI         *string `json:"spotify_track_uri"`
+	ReasonStart string  `json:"reason_start"`
+	ReasonEnd   string  `json:"reason_end"`
+	Shuffle     bool    `json:"shuffle"`
+	Skipped     *bool   `json:"skipped"`
+}
+
+// Play is one time a song was played on Spotify.
+type Play struct {
+	Artist    string
+	Title     string
+	Album     string
+	URI       string
+	Timestamp time.Time // when the song stopped playing
+	Played    time.Duration
+	// ReasonStart and ReasonEnd are why the song started and stopped,
+	// like "trackdone", "fwdbtn", or "endplay".
+	ReasonStart string
+	ReasonEnd   string
+	Shuffle     bool
+	Skipped     bool
+}
+
+// WasSkipped reports whether the song was skipped, either according to
+// Spotify or because the next button stopped it.
+func (p Play) WasSkipped() bool {
+	return p.Skipped || p.ReasonEnd == "fwdbtn"
+}
+
+// ReadPlays reads the songs played from one streaming history file.
+// Podcast episodes and anything else without a track are left out.
+func ReadPlays(r io.Reader) ([]Play, error) {
+	entries := make([]entry, 0)
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, errors.New("Couldn't read the streaming history: " + err.Error())
+	}
+	plays := make([]Play, 0, len(entries))
+	for _, e := range entries {
+		if e.Title == nil || e.Artist == nil {
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339, e.Timestamp)
+		if err != nil {
+			continue
+		}
+		p := Play{
+			Artist:      *e.Artist,
+			Title:       *e.Title,
+			Timestamp:   ts,
+			Played:      time.Duration(e.MsPlayed) * time.Millisecond,
+			ReasonStart: e.ReasonStart,
+			ReasonEnd:   e.ReasonEnd,
+			Shuffle:     e.Shuffle,
+			Skipped:     e.Skipped != nil && *e.Skipped,
+		}
+		if e.Album != nil {
+			p.Album = *e.Album
+		}
+		if e.URI != nil {
+			p.URI = *e.URI
+		}
+		plays = append(plays, p)
+	}
+	return plays, nil
+}
+
+// ReadFiles reads the plays from every file, since Spotify splits the
+// history up into several. The plays are returned oldest first.
+func ReadFiles(paths []string) ([]Play, error) {
+	plays := make([]Play, 0)
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		filePlays, err := ReadPlays(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.New(path + ": " + err.Error())
+		}
+		plays = append(plays, filePlays...)
+	}
+	sort.SliceStable(plays, func(i, j int) bool {
+		return plays[i].Timestamp.Before(plays[j].Timestamp)
+	})
+	return plays, nil
+}
+
+// Songs turns plays into a listening history like a Last.FM one.
+// Plays shorter than minPlayed are left out, the same way that Last.FM
+// only scrobbles songs that have been listened to for long enough.
+func Songs(plays []Play, minPlayed time.Duration) []lastFm.Song {
+	songs := make([]lastFm.Song, 0, len(plays))
+	for _, p := range plays {
+		if p.Played < minPlayed {
+			continue
+		}
+		songs = append(songs, lastFm.Song{Artist: p.Artist, Title: p.Title, Timestamp: p.Timestamp, Album: p.Album})
+	}
+	return songs
+}
+
+// SkipFeedback turns skips into feedback. A skipped song that played for
+// at least minPlayed, and so is in the history from Songs, gets a thumbs
+// down on the transition from the song kept before it. Most skips are
+// shorter than that and aren't in the history, so the song itself gets
+// the thumbs down instead.
+func SkipFeedback(plays []Play, minPlayed time.Duration) markov.Feedback {
+	f := markov.NewFeedback()
+	var prev *Play // the last play kept in the history
+	for i := range plays {
+		p := &plays[i]
+		kept := p.Played >= minPlayed
+		if p.WasSkipped() {
+			song := lastFm.BaseSong{Artist: p.Artist, Title: p.Title}
+			if kept && prev != nil {
+				f.RateTransition(markov.Transition{From: lastFm.BaseSong{Artist: prev.Artist, Title: prev.Title}, To: song}, false)
+			} else {
+				f.RateSong(song, false)
+			}
+		}
+		if kept {
+			prev = p
+		}
+	}
+	return f
+}
+
+// Source is a lastFm.HistorySource that reads streaming history files.
+// The files are only read once, no matter how many times they're used.
+type Source struct {
+	Paths     []string
+	MinPlayed time.Duration
+
+	once  sync.Once
+	plays []Play
+	err   error
+}
+
+// Plays returns every play in the files, oldest first.
+func (s *Source) Plays() ([]Play, error) {
+	s.once.Do(func() {
+		s.plays, s.err = ReadFiles(s.Paths)
+	})
+	return s.plays, s.err
+}
+
+// History returns the songs played for long enough, oldest first.
+// The files belong to one account, so the user ID isn't used.
+func (s *Source) History(ctx context.Context, userID string) ([]lastFm.Song, error) {
+	plays, err := s.Plays()
+	if err != nil {
+		return nil, err
+	}
+	songs := Songs(plays, s.MinPlayed)
+	if len(songs) == 0 {
+		return nil, errors.New("No songs in the streaming history were played for long enough.")
+	}
+	return songs, nil
+}
@@ -0,0 +1,54 @@
+package spotifyHistory
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/snyderks/spotkov/lastFm"
+)
+
+const testHistory = `[
+{"ts": "2023-03-01T10:04:00Z", "ms_played": 240000, "master_metadata_track_name": "Madness", "master_metadata_album_artist_name": "Muse", "master_metadata_album_album_name": "The 2nd Law", "spotify_track_uri": "spotify:track:1", "reason_start": "clickrow", "reason_end": "trackdone", "shuffle": false, "skipped": null},
+{"ts": "2023-03-01T10:04:05Z", "ms_played": 5000, "master_metadata_track_name": "Roads", "master_metadata_album_artist_name": "Portishead", "master_metadata_album_album_name": "Dummy", "spotify_track_uri": "spotify:track:2", "reason_start": "trackdone", "reason_end": "fwdbtn", "shuffle": false, "skipped": true},
+{"ts": "2023-03-01T10:00:00Z", "ms_played": 1800000, "master_metadata_track_name": null, "master_metadata_album_artist_name": null, "master_metadata_album_album_name": null, "spotify_track_uri": null, "episode_name": "A podcast", "reason_start": "clickrow", "reason_end": "endplay"},
+{"ts": "2023-03-01T10:09:00Z", "ms_played": 300000, "master_metadata_track_name": "Joga", "master_metadata_album_artist_name": "Bjork", "master_metadata_album_album_name": "Homogenic", "spotify_track_uri": "spotify:track:3", "reason_start": "fwdbtn", "reason_end": "trackdone", "shuffle": true, "skipped": false}
+]`
+
+// TestReadPlays checks that podcasts are left out, short plays are filtered,
+// and skips become thumbs down.
+func TestReadPlays(t *testing.T) {
+	plays, err := ReadPlays(strings.NewReader(testHistory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plays) != 3 {
+		t.Fatal("Expected 3 plays without the podcast, got", len(plays))
+	}
+	if !plays[1].WasSkipped() || plays[0].WasSkipped() {
+		t.Error("Skips weren't read correctly.")
+	}
+
+	songs := Songs(plays, 30*time.Second)
+	if len(songs) != 2 || songs[0].Title != "Madness" || songs[1].Title != "Joga" {
+		t.Error("Expected Madness and Joga, got", songs)
+	}
+
+	// Roads was skipped too soon to be in the history, so it's the song
+	// that gets a thumbs down.
+	f := SkipFeedback(plays, 30*time.Second)
+	if len(f.Transitions) != 0 || len(f.Songs) != 1 || f.Songs[lastFm.BaseSong{Artist: "Portishead", Title: "Roads"}] != -1 {
+		t.Error("Expected only Roads to get a thumbs down, got", f.Songs, f.Transitions)
+	}
+	// Once it's in the history, the transition from the song kept before
+	// it does.
+	f = SkipFeedback(plays, time.Second)
+	if len(f.Songs) != 0 || len(f.Transitions) != 1 {
+		t.Fatal("Expected one transition with a thumbs down, got", f.Transitions)
+	}
+	for transition, votes := range f.Transitions {
+		if transition.From.Title != "Madness" || transition.To.Title != "Roads" || votes != -1 {
+			t.Error("The wrong transition got a thumbs down:", transition, votes)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package spotifyPlaylistGenerator
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
@@ -12,7 +13,8 @@ import (
 	"github.com/zmb3/spotify"
 )
 
-const playlistName = "Generated by Spotkov"
+// PlaylistName is the name of the playlist that Spotkov writes to.
+const PlaylistName = "Generated by Spotkov"
 const maxSongLength = 50
 const songIDPrefix = "songIDs."
 
@@ -30,13 +32,28 @@ type songIDs struct {
 var IDs songIDs
 
 // songAndArtist is used as a key for a map
-// to organize song IDs with.
+// to organize song IDs with. It holds the canonical forms from
+// tools.Canonical, so every way of writing a song shares an ID.
 type songAndArtist struct {
 	Title  string
 	Artist string
 }
 
+// songKey returns the key for a song in the map of IDs.
+func songKey(title string, artist string) songAndArtist {
+	key := tools.Canonical(artist, title)
+	return songAndArtist{key.Title, key.Artist}
+}
+
+// CreatePlaylist replaces the songs in the user's Spotkov playlist with songs,
+// creating the playlist if it doesn't exist yet.
 func CreatePlaylist(songs []lastFm.Song, client *spotify.Client, userID string) error {
+	return CreateNamedPlaylist(songs, client, userID, PlaylistName)
+}
+
+// CreateNamedPlaylist replaces the songs in the user's playlist called
+// playlistName with songs, creating the playlist if it doesn't exist yet.
+func CreateNamedPlaylist(songs []lastFm.Song, client *spotify.Client, userID string, playlistName string) error {
 	playlistsPage, err := client.GetPlaylistsForUser(userID)
 	playlistExists := false
 	var playlistId spotify.ID
@@ -110,7 +127,7 @@ func CreatePlaylist(songs []lastFm.Song, client *spotify.Client, userID string)
 				_, err := client.AddTracksToPlaylist(userID, playlistId, trackChunk...)
 				for err != nil {
 					if attempts >= maxAttempts {
-						s := fmt.Sprint("Adding some tracks failed. The playlist contains at least" + string(maxSongLength) + "tracks.")
+						s := fmt.Sprint("Adding some tracks failed. The playlist contains at least" + strconv.Itoa(maxSongLength) + "tracks.")
 						fmt.Println(s)
 						return errors.New(s)
 					}
@@ -135,7 +152,7 @@ func searchAndAddTrackToList(client *spotify.Client, title string, artist string
 	// check if there's already a known ID for this song
 	// read lock the map
 	IDs.RLock()
-	id, in := IDs.M[songAndArtist{title, artist}]
+	id, in := IDs.M[songKey(title, artist)]
 	IDs.RUnlock()
 
 	if in {
@@ -178,7 +195,7 @@ func searchAndAddTrackToList(client *spotify.Client, title string, artist string
 			// save the ID in the known list
 			// lock and unlock with the embedded mutex
 			IDs.Lock()
-			IDs.M[songAndArtist{title, artist}] = trackID
+			IDs.M[songKey(title, artist)] = trackID
 			IDs.Unlock()
 		} else if debugMessages {
 			fmt.Println("Got no results for query:", query)
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/snyderks/spotkov/lastFm"
+)
+
+// runSync brings a user's cached scrobbles up to date with Last.FM,
+// and with -verify, finds and refetches months that don't match.
+func runSync(arguments []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	user := flags.String("lastFm", "", "Your Last.FM User ID")
+	verify := flags.Bool("verify", false, "Check the cache against Last.FM month by month and refetch any months that don't match")
+	flags.Parse(arguments)
+
+	if *user == "" {
+		fmt.Println("sync needs -lastFm. Use -help for details.")
+		os.Exit(2)
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	opts := lastFm.FetchOptions{Progress: printProgress("pages of scrobbles")}
+	songs, err := lastFm.ReadLastFMSongsWithOptions(ctx, *user, opts)
+	if err != nil {
+		fmt.Println()
+		fmt.Println("Couldn't sync your scrobbles:", err)
+		fmt.Println("Anything fetched so far was saved, so run sync again to carry on.")
+		os.Exit(1)
+	}
+	fmt.Println("You have", len(songs), "scrobbles cached.")
+	if !*verify {
+		return
+	}
+
+	fmt.Println("Checking them against Last.FM...")
+	gaps, err := lastFm.VerifyHistory(ctx, *user, opts)
+	if err != nil {
+		fmt.Println("Couldn't verify your scrobbles:", err)
+		os.Exit(1)
+	}
+	if len(gaps) == 0 {
+		fmt.Println("Everything matches.")
+		return
+	}
+	for _, gap := range gaps {
+		printGap(gap)
+	}
+
+	fmt.Println("Refetching", len(gaps), "months...")
+	remaining, err := lastFm.RepairHistory(ctx, *user, gaps, opts)
+	if err != nil {
+		fmt.Println("Couldn't repair your scrobbles:", err)
+		os.Exit(1)
+	}
+	if len(remaining) == 0 {
+		fmt.Println("Everything matches now.")
+		return
+	}
+	fmt.Println("These months still don't match. Scrobbles might have changed while they were fetched, so try again later:")
+	for _, gap := range remaining {
+		printGap(gap)
+	}
+}
+
+// printGap describes a month that doesn't match Last.FM.
+func printGap(gap lastFm.Gap) {
+	month := gap.From.Format("January 2006")
+	if missing := gap.Missing(); missing > 0 {
+		fmt.Printf("  %s: %d of %d scrobbles are missing\n", month, missing, gap.Scrobbled)
+	} else {
+		fmt.Printf("  %s: %d scrobbles are cached but Last.FM has %d\n", month, gap.Cached, gap.Scrobbled)
+	}
+}
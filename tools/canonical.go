@@ -0,0 +1,177 @@
+package tools
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// SongKey is the canonical form of a song. Every way of writing the same
+// song, like with different capitalization, accents, a featured artist or
+// "Remastered 2011" on the end, has the same key.
+type SongKey struct {
+	Artist string
+	Title  string
+}
+
+// TitleParts is a song title split into the song itself and the
+// suffixes that only say which version of it was played.
+type TitleParts struct {
+	Base      string   // the title without any of the suffixes
+	Featuring []string // featured artists, as written
+	Remaster  bool
+	Live      bool
+	Versions  []string // every suffix that was removed, as written
+}
+
+// ArtistAliases maps the canonical form of another name for an artist to
+// the canonical form of the name to use instead.
+type ArtistAliases map[string]string
+
+var (
+	// bracketSuffix matches a part in brackets at the end of a title.
+	bracketSuffix = regexp.MustCompile(`\s*[(\[]([^()\[\]]*)[)\]]\s*$`)
+	// dashSuffix matches a part after a spaced dash at the end of a title.
+	dashSuffix = regexp.MustCompile(`\s+[-–—]\s+([^-–—]*)$`)
+	// featuring matches the start of a list of featured artists.
+	featuring       = regexp.MustCompile(`(?i)(^|\s)(feat\.?|ft\.?|featuring)\s+`)
+	featuringSuffix = regexp.MustCompile(`(?i)^(feat\.?|ft\.?|featuring)\s+`)
+	withSuffix      = regexp.MustCompile(`(?i)^with\s+`)
+	remaster        = regexp.MustCompile(`(?i)\bremaster(ed)?\b`)
+	live            = regexp.MustCompile(`(?i)(^live( at .*| from .*| in .*| on .*)?$|\blive( version| recording)?$)`)
+	version         = regexp.MustCompile(`(?i)^((mono|stereo)( version| mix)?|(single|album|radio) (version|edit)|\d{4} (version|mix))$`)
+	// artistSeparator separates artists in a list of them.
+	artistSeparator = regexp.MustCompile(`\s*(,|&|\sand\s)\s*`)
+)
+
+// Fold puts s into a form for comparing names. It applies Unicode NFKC
+// normalization, removes accents, and then does the same as
+// LowerAndStripNonAlphaNumeric, with runs of spaces made into one.
+func Fold(s string) string {
+	// The chain keeps state, so each call needs its own.
+	accents := transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)), norm.NFKC)
+	folded, _, err := transform.String(accents, norm.NFKC.String(s))
+	if err != nil {
+		folded = norm.NFKC.String(s)
+	}
+	return strings.Join(strings.Fields(LowerAndStripNonAlphaNumeric(folded)), " ")
+}
+
+// ParseTitle splits the suffixes that say which version of a song was
+// played off of its title. These are featured artists, remasters, live
+// recordings, and mono, stereo, single or radio versions, either in
+// brackets or after a dash: "Song (feat. X)", "Song - Remastered 2011" and
+// "Song - Live at Y" are all versions of "Song".
+// Anything else, like "(Reprise)", is left as part of the title.
+func ParseTitle(title string) TitleParts {
+	parts := TitleParts{Base: strings.TrimSpace(title)}
+	for {
+		loc := bracketSuffix.FindStringSubmatchIndex(parts.Base)
+		bracketed := loc != nil
+		if !bracketed {
+			loc = dashSuffix.FindStringSubmatchIndex(parts.Base)
+		}
+		if loc == nil || loc[0] == 0 || !parts.add(parts.Base[loc[2]:loc[3]], bracketed) {
+			break
+		}
+		parts.Base = strings.TrimSpace(parts.Base[:loc[0]])
+	}
+	// Featured artists aren't always in brackets.
+	if loc := featuring.FindStringIndex(parts.Base); loc != nil && loc[0] > 0 {
+		parts.Featuring = append(parts.Featuring, splitArtists(parts.Base[loc[1]:])...)
+		parts.Versions = append(parts.Versions, strings.TrimSpace(parts.Base[loc[0]:]))
+		parts.Base = strings.TrimSpace(parts.Base[:loc[0]])
+	}
+	return parts
+}
+
+// add records suffix as part of the version if it's one, and reports
+// whether it was. "With" only means a featured artist in brackets, since
+// after a dash it's more likely to be part of the title.
+func (p *TitleParts) add(suffix string, bracketed bool) bool {
+	suffix = strings.TrimSpace(suffix)
+	switch {
+	case featuringSuffix.MatchString(suffix):
+		p.Featuring = append(p.Featuring, splitArtists(featuringSuffix.ReplaceAllString(suffix, ""))...)
+	case bracketed && withSuffix.MatchString(suffix):
+		p.Featuring = append(p.Featuring, splitArtists(withSuffix.ReplaceAllString(suffix, ""))...)
+	case remaster.MatchString(suffix):
+		p.Remaster = true
+	case live.MatchString(suffix):
+		p.Live = true
+	case version.MatchString(suffix):
+		// Only recorded in Versions.
+	default:
+		return false
+	}
+	p.Versions = append(p.Versions, suffix)
+	return true
+}
+
+// splitArtists splits a list of artists like "A, B & C".
+func splitArtists(list string) []string {
+	artists := make([]string, 0)
+	for _, a := range artistSeparator.Split(list, -1) {
+		if a = strings.TrimSpace(a); a != "" {
+			artists = append(artists, a)
+		}
+	}
+	return artists
+}
+
+// MainArtist returns the artist a song is by, without any featured
+// artists that were added to the name.
+func MainArtist(artist string) string {
+	if loc := featuring.FindStringIndex(artist); loc != nil && loc[0] > 0 {
+		artist = artist[:loc[0]]
+	}
+	return strings.TrimSpace(artist)
+}
+
+// CanonicalTitle returns the canonical form of a song title.
+func CanonicalTitle(title string) string {
+	if base := Fold(ParseTitle(title).Base); base != "" {
+		return base
+	}
+	// Titles without any letters or digits are kept as they are.
+	return strings.ToLower(strings.TrimSpace(norm.NFKC.String(title)))
+}
+
+// CanonicalArtist returns the canonical form of an artist's name.
+// Featured artists and a leading "The" are dropped, and "&" and "+" are
+// the same as "and".
+func CanonicalArtist(artist string) string {
+	return ArtistAliases(nil).Artist(artist)
+}
+
+// Canonical returns the key for a song.
+func Canonical(artist, title string) SongKey {
+	return ArtistAliases(nil).Canonical(artist, title)
+}
+
+// Artist returns the canonical form of an artist's name, like
+// CanonicalArtist, and then the name it's an alias of if it's one.
+func (a ArtistAliases) Artist(artist string) string {
+	name := MainArtist(artist)
+	name = strings.NewReplacer("&", " and ", "+", " and ").Replace(name)
+	folded := Fold(name)
+	if folded == "" {
+		folded = strings.ToLower(strings.TrimSpace(norm.NFKC.String(artist)))
+	}
+	if strings.HasPrefix(folded, "the ") {
+		folded = folded[len("the "):]
+	}
+	if alias, ok := a[folded]; ok {
+		return alias
+	}
+	return folded
+}
+
+// Canonical returns the key for a song, using the aliases for the artist.
+func (a ArtistAliases) Canonical(artist, title string) SongKey {
+	return SongKey{Artist: a.Artist(artist), Title: CanonicalTitle(title)}
+}
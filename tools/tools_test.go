@@ -1,6 +1,9 @@
 package tools
 
-import "testing"
+import (
+	"math"
+	"testing"
+)
 
 // TestLowerAndStripNonAlphaNumeric checks that the method:
 // leaves only spaces, numbers, and letters as well as
@@ -22,3 +25,71 @@ func TestLowerAndStripNonAlphaNumeric(T *testing.T) {
 		}
 	}
 }
+
+// TestCanonical checks that the ways a song is commonly written all have
+// the same key, and that different songs don't.
+func TestCanonical(T *testing.T) {
+	same := [][2]string{
+		{"Queen", "Bohemian Rhapsody"},
+		{"Queen", "Bohemian Rhapsody - Remastered 2011"},
+		{"Queen", "Bohemian Rhapsody (2011 Remaster)"},
+		{"Queen", "Bohemian Rhapsody - Live at Wembley '86"},
+		{"Queen", "BOHEMIAN RHAPSODY [Live]"},
+		{"Queen feat. David Bowie", "Bohemian  Rhapsody (feat. Someone) - Mono Version"},
+		{"The Queen", "Bohemian Rhapsody ft. Someone & Someone Else"},
+		{"Ｑｕｅｅｎ", "Bohemián Rhapsody"},
+	}
+	want := Canonical(same[0][0], same[0][1])
+	if want != (SongKey{Artist: "queen", Title: "bohemian rhapsody"}) {
+		T.Error("Expected queen and bohemian rhapsody, got", want)
+	}
+	for _, s := range same[1:] {
+		if got := Canonical(s[0], s[1]); got != want {
+			T.Error(s[1], "by", s[0], "was", got, "instead of", want)
+		}
+	}
+
+	different := [][2]string{
+		{"Queen", "Bohemian Rhapsody (Reprise)"},
+		{"Queen", "Live"},
+		{"Muse", "Bohemian Rhapsody"},
+	}
+	for _, s := range different {
+		if got := Canonical(s[0], s[1]); got == want {
+			T.Error(s[1], "by", s[0], "shouldn't be the same song as", same[0][1])
+		}
+	}
+	if Canonical("Simon & Garfunkel", "x") != Canonical("Simon and Garfunkel", "x") {
+		T.Error("& and and should be the same in artists")
+	}
+
+	parts := ParseTitle("Under Pressure (feat. David Bowie) - Remastered 2011")
+	if parts.Base != "Under Pressure" || !parts.Remaster || parts.Live ||
+		len(parts.Featuring) != 1 || parts.Featuring[0] != "David Bowie" {
+		T.Error("Under Pressure was parsed wrong:", parts)
+	}
+
+	aliases := ArtistAliases{"prince and the revolution": "prince"}
+	if got := aliases.Canonical("Prince & The Revolution", "Purple Rain"); got.Artist != "prince" {
+		T.Error("Expected the alias to be used, got", got)
+	}
+}
+
+// TestSimilarity checks how alike some strings are said to be.
+func TestSimilarity(T *testing.T) {
+	cases := []struct {
+		a, b string
+		want float64
+	}{
+		{"", "", 1},
+		{"madness", "madness", 1},
+		{"madness", "madnes", 1 - 1.0/7},
+		{"abc", "xyz", 0},
+		{"björk", "bjork", 0.8},
+	}
+	for _, c := range cases {
+		if got := Similarity(c.a, c.b); math.Abs(got-c.want) > 1e-9 {
+			T.Error(c.a, "and", c.b, "were", got, "alike instead of", c.want)
+		}
+	}
+}